@@ -0,0 +1,158 @@
+package geerpc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Authenticator verifies the AuthData sent by a client in the Option when it
+// connects, and returns the principal identifying the client, e.g. a user name.
+// Connections of clients failing to authenticate are closed.
+type Authenticator interface {
+	Authenticate(p *Peer, authData map[string]string) (principal string, err error)
+}
+
+// AuthenticatorFunc is an adapter to use a function as Authenticator
+type AuthenticatorFunc func(p *Peer, authData map[string]string) (string, error)
+
+func (f AuthenticatorFunc) Authenticate(p *Peer, authData map[string]string) (string, error) {
+	return f(p, authData)
+}
+
+// Credentials produces the AuthData a client sends when it connects,
+// it's called on every dial so that it may sign the current time.
+type Credentials interface {
+	AuthData() (map[string]string, error)
+}
+
+// TokenCredentials sends a bearer token
+type TokenCredentials string
+
+func (t TokenCredentials) AuthData() (map[string]string, error) {
+	return map[string]string{"token": string(t)}, nil
+}
+
+// TokenAuthenticator authenticates TokenCredentials, tokens maps a token to its principal.
+func TokenAuthenticator(tokens map[string]string) Authenticator {
+	return AuthenticatorFunc(func(_ *Peer, authData map[string]string) (string, error) {
+		principal, ok := tokens[authData["token"]]
+		if !ok {
+			return "", errors.New("invalid token")
+		}
+		return principal, nil
+	})
+}
+
+// HMACCredentials signs the id and the current time with a key shared with the server
+type HMACCredentials struct {
+	ID  string
+	Key []byte
+}
+
+func signHMAC(key []byte, id, timestamp string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id + ":" + timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *HMACCredentials) AuthData() (map[string]string, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	return map[string]string{"id": c.ID, "timestamp": timestamp, "signature": signHMAC(c.Key, c.ID, timestamp)}, nil
+}
+
+// HMACAuthenticator authenticates HMACCredentials, keys maps an id to its key and
+// the id is the principal. Signatures older than maxSkew are rejected.
+func HMACAuthenticator(keys map[string][]byte, maxSkew time.Duration) Authenticator {
+	return AuthenticatorFunc(func(_ *Peer, authData map[string]string) (string, error) {
+		id, timestamp := authData["id"], authData["timestamp"]
+		key, ok := keys[id]
+		if !ok {
+			return "", fmt.Errorf("unknown id %q", id)
+		}
+		sec, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return "", errors.New("invalid timestamp")
+		}
+		if skew := time.Since(time.Unix(sec, 0)); skew > maxSkew || skew < -maxSkew {
+			return "", errors.New("signature expired")
+		}
+		if !hmac.Equal([]byte(authData["signature"]), []byte(signHMAC(key, id, timestamp))) {
+			return "", errors.New("invalid signature")
+		}
+		return id, nil
+	})
+}
+
+// TLSAuthenticator authenticates mutual TLS clients,
+// the common name of the client certificate is the principal.
+func TLSAuthenticator() Authenticator {
+	return AuthenticatorFunc(func(p *Peer, _ map[string]string) (string, error) {
+		cert := p.Identity()
+		if cert == nil {
+			return "", errors.New("no verified client certificate")
+		}
+		return cert.Subject.CommonName, nil
+	})
+}
+
+// ACL maps "Service.Method", "Service.*" or "*" to the principals allowed to
+// call the matching methods, the principal "*" allows any client.
+// The most specific rule applies, and methods without a rule can't be called.
+type ACL map[string][]string
+
+func (acl ACL) allow(principal, serviceMethod string) bool {
+	principals, ok := acl[serviceMethod]
+	if !ok {
+		if dot := strings.LastIndex(serviceMethod, "."); dot >= 0 {
+			principals, ok = acl[serviceMethod[:dot]+".*"]
+		}
+	}
+	if !ok {
+		principals = acl["*"]
+	}
+	for _, p := range principals {
+		if p == "*" || p == principal {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAuthenticator makes the server authenticate clients with a when they connect.
+// It should be called before serving.
+func (server *Server) SetAuthenticator(a Authenticator) {
+	server.authenticator = a
+}
+
+// SetACL makes the server check every call against acl, nil allows all calls.
+// It should be called before serving.
+func (server *Server) SetACL(acl ACL) {
+	server.acl = acl
+}
+
+// authenticate returns an error with CodeUnauthenticated if the client is rejected
+func (server *Server) authenticate(p *Peer, authData map[string]string) error {
+	if server.authenticator == nil {
+		return nil
+	}
+	principal, err := server.authenticator.Authenticate(p, authData)
+	if err != nil {
+		return Errorf(CodeUnauthenticated, "unauthenticated: %v", err)
+	}
+	p.Principal = principal
+	return nil
+}
+
+// authorize returns an error with CodePermissionDenied if the ACL rejects the call
+func (server *Server) authorize(p *Peer, serviceMethod string) error {
+	if server.acl == nil || server.acl.allow(p.Principal, serviceMethod) {
+		return nil
+	}
+	return Errorf(CodePermissionDenied, "rpc server: permission denied: %q can't call %s", p.Principal, serviceMethod)
+}
@@ -27,6 +27,7 @@ type Call struct {
 	Args          interface{} // arguments to the function
 	Reply         interface{} // reply from the function
 	Error         error       // if error occurs, it will be set
+	Metadata      Metadata    // metadata sent back with the response
 	Done          chan *Call  // Strobes when call is complete.
 }
 
@@ -39,15 +40,24 @@ func (call *Call) done() {
 // with a single Client, and a Client may be used by
 // multiple goroutines simultaneously.
 type Client struct {
-	cc       codec.Codec
-	opt      *Option
-	sending  sync.Mutex // protect following
-	header   codec.Header
-	mu       sync.Mutex // protect following
-	seq      uint64
-	pending  map[uint64]*Call
-	closing  bool // user has called Close
-	shutdown bool // server has told us to stop
+	alive        liveness
+	done         chan struct{} // closed once the connection is broken
+	closed       chan struct{} // closed by Close
+	redial       func() (codec.Codec, error)
+	cc           codec.Codec
+	opt          *Option
+	interceptors []UnaryClientInterceptor
+	sending      sync.Mutex // protect following
+	header       codec.Header
+	mu           sync.Mutex // protect following
+	seq          uint64
+	pending      map[uint64]*Call
+	streams      map[uint64]*ClientStream
+	closing      bool  // user has called Close
+	shutdown     bool  // server has told us to stop
+	draining     bool  // server is shutting down, pending calls are still served
+	reconnecting bool  // connection is broken and being redialed
+	pingErr      error // set when the server didn't answer a ping
 }
 
 var _ io.Closer = (*Client)(nil)
@@ -57,25 +67,36 @@ var ErrShutdown = errors.New("connection is shut down")
 // Close the connection
 func (client *Client) Close() error {
 	client.mu.Lock()
-	defer client.mu.Unlock()
 	if client.closing {
+		client.mu.Unlock()
 		return ErrShutdown
 	}
 	client.closing = true
-	return client.cc.Close()
+	close(client.closed)
+	cc := client.cc
+	client.mu.Unlock()
+	// closing may wait for the messages queued by a framed codec to be sent
+	return cc.Close()
 }
 
 // IsAvailable return true if the client does work
 func (client *Client) IsAvailable() bool {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	return !client.shutdown && !client.closing
+	return !client.shutdown && !client.closing && !client.draining && !client.reconnecting
+}
+
+// NumPending returns the number of calls and streams waiting for the server
+func (client *Client) NumPending() int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return len(client.pending) + len(client.streams)
 }
 
 func (client *Client) registerCall(call *Call) (uint64, error) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	if client.closing || client.shutdown {
+	if client.closing || client.shutdown || client.draining || client.reconnecting {
 		return 0, ErrShutdown
 	}
 	call.Seq = client.seq
@@ -93,18 +114,34 @@ func (client *Client) removeCall(seq uint64) *Call {
 }
 
 func (client *Client) terminateCalls(err error) {
-	client.sending.Lock()
-	defer client.sending.Unlock()
 	client.mu.Lock()
-	defer client.mu.Unlock()
 	client.shutdown = true
-	for _, call := range client.pending {
+	client.mu.Unlock()
+	client.failCalls(err)
+}
+
+// failCalls fails the calls and streams in flight with err
+func (client *Client) failCalls(err error) {
+	client.sending.Lock()
+	client.mu.Lock()
+	for seq, call := range client.pending {
+		delete(client.pending, seq)
 		call.Error = err
 		call.done()
 	}
+	streams := make([]*ClientStream, 0, len(client.streams))
+	for _, cs := range client.streams {
+		streams = append(streams, cs)
+	}
+	client.mu.Unlock()
+	client.sending.Unlock()
+	// finish removes the stream from client, so it's called without the lock
+	for _, cs := range streams {
+		cs.finish(err)
+	}
 }
 
-func (client *Client) send(call *Call) {
+func (client *Client) send(ctx context.Context, call *Call) {
 	// make sure that the client will send a complete request
 	client.sending.Lock()
 	defer client.sending.Unlock()
@@ -118,9 +155,14 @@ func (client *Client) send(call *Call) {
 	}
 
 	// prepare request header
-	client.header.ServiceMethod = call.ServiceMethod
-	client.header.Seq = seq
-	client.header.Error = ""
+	client.header = codec.Header{
+		ServiceMethod: call.ServiceMethod,
+		Seq:           seq,
+		Metadata:      FromOutgoingContext(ctx),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		client.header.Timeout = time.Until(deadline)
+	}
 
 	// encode and send the request
 	if err := client.cc.Write(&client.header, call.Args); err != nil {
@@ -134,21 +176,78 @@ func (client *Client) send(call *Call) {
 	}
 }
 
+// cancel tells the server to stop handling the call of seq,
+// the server won't send a response for it.
+func (client *Client) cancel(seq uint64) {
+	_ = client.writeFrame(&codec.Header{Seq: seq, Cancel: true}, invalidRequest)
+}
+
+// writeFrame writes a message other than a request, e.g. cancel or stream frames
+func (client *Client) writeFrame(h *codec.Header, body interface{}) error {
+	client.mu.Lock()
+	cc := client.cc
+	client.mu.Unlock()
+	waitWritable(cc, h.Seq)
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	return client.cc.Write(h, body)
+}
+
 func (client *Client) receive() {
+	for {
+		err := client.read()
+		client.mu.Lock()
+		if client.pingErr != nil {
+			err = client.pingErr
+		}
+		close(client.done)
+		client.mu.Unlock()
+		if client.redial == nil || !client.reconnect(err) {
+			// error occurs, so terminateCalls pending calls
+			client.terminateCalls(err)
+			return
+		}
+	}
+}
+
+// read handles the messages of the connection until an error occurs
+func (client *Client) read() error {
 	var err error
 	for err == nil {
 		var h codec.Header
 		if err = client.cc.ReadHeader(&h); err != nil {
 			break
 		}
+		client.alive.touch()
+		if h.Ping || h.Pong {
+			if h.Ping {
+				go func() { _ = client.writeFrame(&codec.Header{Pong: true}, invalidRequest) }()
+			}
+			err = client.cc.ReadBody(nil)
+			continue
+		}
+		if h.GoAway {
+			client.mu.Lock()
+			client.draining = true
+			client.mu.Unlock()
+			err = client.cc.ReadBody(nil)
+			continue
+		}
+		if h.Stream {
+			err = client.receiveStream(&h)
+			continue
+		}
 		call := client.removeCall(h.Seq)
+		if call != nil {
+			call.Metadata = h.Metadata
+		}
 		switch {
 		case call == nil:
 			// it usually means that Write partially failed
 			// and call was already removed.
 			err = client.cc.ReadBody(nil)
 		case h.Error != "":
-			call.Error = fmt.Errorf(h.Error)
+			call.Error = newCallError(&h)
 			err = client.cc.ReadBody(nil)
 			call.done()
 		default:
@@ -159,37 +258,86 @@ func (client *Client) receive() {
 			call.done()
 		}
 	}
-	// error occurs, so terminateCalls pending calls
-	client.terminateCalls(err)
+	return err
+}
+
+func (client *Client) receiveStream(h *codec.Header) error {
+	client.mu.Lock()
+	cs := client.streams[h.Seq]
+	client.mu.Unlock()
+	if cs == nil {
+		// the stream has been canceled
+		return client.cc.ReadBody(nil)
+	}
+	err := cs.readFrame(client.cc, h)
+	if h.EOS {
+		cs.finish(io.EOF)
+	}
+	return err
+}
+
+// Use appends interceptors wrapping every Call and Go of the client,
+// the first one is the outermost. It should be called before any call is made.
+func (client *Client) Use(interceptors ...UnaryClientInterceptor) {
+	client.interceptors = append(client.interceptors, interceptors...)
 }
 
 // Go invokes the function asynchronously.
 // It returns the Call structure representing the invocation.
 func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	if len(client.interceptors) == 0 {
+		return client.goContext(context.Background(), serviceMethod, args, reply, done)
+	}
+	call := newCall(serviceMethod, args, reply, done)
+	go func() {
+		ctx := WithResponseMetadata(context.Background(), &call.Metadata)
+		call.Error = chainUnaryClient(client.interceptors, client.call)(ctx, serviceMethod, args, reply)
+		call.done()
+	}()
+	return call
+}
+
+func newCall(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 10)
 	} else if cap(done) == 0 {
 		log.Panic("rpc client: done channel is unbuffered")
 	}
-	call := &Call{
+	return &Call{
 		ServiceMethod: serviceMethod,
 		Args:          args,
 		Reply:         reply,
 		Done:          done,
 	}
-	client.send(call)
+}
+
+// goContext is like Go, but the deadline and metadata of ctx are sent to the server.
+func (client *Client) goContext(ctx context.Context, serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	call := newCall(serviceMethod, args, reply, done)
+	client.send(ctx, call)
 	return call
 }
 
 // Call invokes the named function, waits for it to complete,
 // and returns its error status.
+// The deadline and outgoing metadata of ctx are sent to the server,
+// and the server is told to stop handling the call once ctx is done.
 func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	return chainUnaryClient(client.interceptors, client.call)(ctx, serviceMethod, args, reply)
+}
+
+func (client *Client) call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	call := client.goContext(ctx, serviceMethod, args, reply, make(chan *Call, 1))
 	select {
 	case <-ctx.Done():
-		client.removeCall(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		if client.removeCall(call.Seq) != nil {
+			client.cancel(call.Seq)
+		}
+		return contextError("rpc client: call failed: ", ctx.Err())
 	case call := <-call.Done:
+		if md := responseMetadataFromContext(ctx); md != nil {
+			*md = call.Metadata
+		}
 		return call.Error
 	}
 }
@@ -202,28 +350,61 @@ func parseOptions(opts ...*Option) (*Option, error) {
 	if len(opts) != 1 {
 		return nil, errors.New("number of options is more than 1")
 	}
-	opt := opts[0]
+	opt := *opts[0] // the caller may dial concurrently with the same options
 	opt.MagicNumber = DefaultOption.MagicNumber
 	if opt.CodecType == "" {
 		opt.CodecType = DefaultOption.CodecType
 	}
-	return opt, nil
+	return &opt, nil
 }
 
 func NewClient(conn net.Conn, opt *Option) (*Client, error) {
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f == nil {
+	cc, err := handshake(conn, opt)
+	if err != nil {
+		return nil, err
+	}
+	return newClientCodec(cc, opt), nil
+}
+
+// handshake sends opt to the server and returns the codec of conn once the server accepts it
+func handshake(conn net.Conn, opt *Option) (codec.Codec, error) {
+	f, ok := codec.Lookup(opt.CodecType)
+	if !ok {
 		err := fmt.Errorf("invalid codec type %s", opt.CodecType)
 		log.Println("rpc client: codec error:", err)
 		return nil, err
 	}
-	// send options with server
-	if err := json.NewEncoder(conn).Encode(opt); err != nil {
+	// send options with server, along with fresh credentials
+	wire := *opt
+	if opt.Credentials != nil {
+		authData, err := opt.Credentials.AuthData()
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		wire.AuthData = authData
+	}
+	if err := json.NewEncoder(conn).Encode(&wire); err != nil {
 		log.Println("rpc client: options error: ", err)
 		_ = conn.Close()
 		return nil, err
 	}
-	return newClientCodec(f(conn), opt), nil
+	// wait for server to accept the options
+	var hs Handshake
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&hs); err != nil {
+		log.Println("rpc client: handshake error: ", err)
+		_ = conn.Close()
+		return nil, err
+	}
+	if hs.Error != "" {
+		_ = conn.Close()
+		if hs.Code != CodeUnknown {
+			return nil, &Status{Code: hs.Code, Message: "rpc server: " + hs.Error}
+		}
+		return nil, fmt.Errorf("rpc server: %s, supported codecs %v", hs.Error, hs.Codecs)
+	}
+	return newCodec(f, &bufferedConn{conn, io.MultiReader(dec.Buffered(), conn)}, opt), nil
 }
 
 func newClientCodec(cc codec.Codec, opt *Option) *Client {
@@ -232,23 +413,44 @@ func newClientCodec(cc codec.Codec, opt *Option) *Client {
 		cc:      cc,
 		opt:     opt,
 		pending: make(map[uint64]*Call),
+		streams: make(map[uint64]*ClientStream),
+		done:    make(chan struct{}),
+		closed:  make(chan struct{}),
 	}
+	client.alive.touch()
+	client.keepalive(cc, client.done)
 	go client.receive()
 	return client
 }
 
-type clientResult struct {
-	client *Client
-	err    error
+type codecResult struct {
+	cc  codec.Codec
+	err error
 }
 
-type newClientFunc func(conn net.Conn, opt *Option) (client *Client, err error)
+// handshakeFunc sets up the RPC protocol on a new connection
+type handshakeFunc func(conn net.Conn, opt *Option) (cc codec.Codec, err error)
 
-func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (client *Client, err error) {
+func dialTimeout(f handshakeFunc, network, address string, opts ...*Option) (*Client, error) {
 	opt, err := parseOptions(opts...)
 	if err != nil {
 		return nil, err
 	}
+	cc, err := dialCodec(f, network, address, opt)
+	if err != nil {
+		return nil, err
+	}
+	client := newClientCodec(cc, opt)
+	if opt.Reconnect != nil {
+		client.redial = func() (codec.Codec, error) {
+			return dialCodec(f, network, address, opt)
+		}
+	}
+	return client, nil
+}
+
+// dialCodec connects to address and runs f on the connection within opt.ConnectTimeout
+func dialCodec(f handshakeFunc, network, address string, opt *Option) (cc codec.Codec, err error) {
 	conn, err := net.DialTimeout(network, address, opt.ConnectTimeout)
 	if err != nil {
 		return nil, err
@@ -259,37 +461,46 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (cli
 			_ = conn.Close()
 		}
 	}()
-	ch := make(chan clientResult)
+	ch := make(chan codecResult)
 	go func() {
-		client, err := f(conn, opt)
-		ch <- clientResult{client: client, err: err}
+		cc, err := f(conn, opt)
+		ch <- codecResult{cc: cc, err: err}
 	}()
 	if opt.ConnectTimeout == 0 {
 		result := <-ch
-		return result.client, result.err
+		return result.cc, result.err
 	}
 	select {
 	case <-time.After(opt.ConnectTimeout):
 		return nil, fmt.Errorf("rpc client: connect timeout: expect within %s", opt.ConnectTimeout)
 	case result := <-ch:
-		return result.client, result.err
+		return result.cc, result.err
 	}
 }
 
 // Dial connects to an RPC server at the specified network address
 func Dial(network, address string, opts ...*Option) (*Client, error) {
-	return dialTimeout(NewClient, network, address, opts...)
+	return dialTimeout(handshake, network, address, opts...)
 }
 
 // NewHTTPClient new a Client instance via HTTP as transport protocol
 func NewHTTPClient(conn net.Conn, opt *Option) (*Client, error) {
+	cc, err := httpHandshake(conn, opt)
+	if err != nil {
+		return nil, err
+	}
+	return newClientCodec(cc, opt), nil
+}
+
+// httpHandshake switches conn from HTTP to the RPC protocol
+func httpHandshake(conn net.Conn, opt *Option) (codec.Codec, error) {
 	_, _ = io.WriteString(conn, fmt.Sprintf("CONNECT %s HTTP/1.0\n\n", defaultRPCPath))
 
 	// Require successful HTTP response
 	// before switching to RPC protocol.
 	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
 	if err == nil && resp.Status == connected {
-		return NewClient(conn, opt)
+		return handshake(conn, opt)
 	}
 	if err == nil {
 		err = errors.New("unexpected HTTP response: " + resp.Status)
@@ -300,13 +511,14 @@ func NewHTTPClient(conn net.Conn, opt *Option) (*Client, error) {
 // DialHTTP connects to an HTTP RPC server at the specified network address
 // listening on the default HTTP RPC path.
 func DialHTTP(network, address string, opts ...*Option) (*Client, error) {
-	return dialTimeout(NewHTTPClient, network, address, opts...)
+	return dialTimeout(httpHandshake, network, address, opts...)
 }
 
 // XDial calls different functions to connect to a RPC server
 // according the first parameter rpcAddr.
 // rpcAddr is a general format (protocol@addr) to represent a rpc server
-// eg, http@10.0.0.1:7001, tcp@10.0.0.1:9999, unix@/tmp/geerpc.sock
+// eg, http@10.0.0.1:7001, tcp@10.0.0.1:9999, unix@/tmp/geerpc.sock,
+// tls@10.0.0.1:9999, https@10.0.0.1:7001 (TLS configured by Option.TLSConfig)
 func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
 	parts := strings.Split(rpcAddr, "@")
 	if len(parts) != 2 {
@@ -316,6 +528,10 @@ func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
 	switch protocol {
 	case "http":
 		return DialHTTP("tcp", addr, opts...)
+	case "tls":
+		return DialTLS("tcp", addr, opts...)
+	case "https":
+		return DialHTTPS("tcp", addr, opts...)
 	default:
 		// tcp, unix or other transport protocol
 		return Dial(protocol, addr, opts...)
@@ -2,10 +2,27 @@ package geerpc
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	pb "geecache/protobuf"
+	"geerpc/codec"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"net/http"
 	"os"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -30,10 +47,10 @@ func TestClient_dialTimeout(t *testing.T) {
 	t.Parallel()
 	l, _ := net.Listen("tcp", ":0")
 
-	f := func(conn net.Conn, opt *Option) (client *Client, err error) {
+	f := func(conn net.Conn, opt *Option) (cc codec.Codec, err error) {
 		_ = conn.Close()
 		time.Sleep(time.Second * 2)
-		return nil, nil
+		return codec.NewGobCodec(conn), nil
 	}
 	t.Run("timeout", func(t *testing.T) {
 		_, err := dialTimeout(f, "tcp", l.Addr().String(), &Option{ConnectTimeout: time.Second})
@@ -53,7 +70,8 @@ func TestClient_Call(t *testing.T) {
 	time.Sleep(time.Second)
 	t.Run("client timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr)
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
 		var reply int
 		err := client.Call(ctx, "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), ctx.Err().Error()), "expect a timeout error")
@@ -76,7 +94,8 @@ func TestXDial(t *testing.T) {
 			_ = os.Remove(addr)
 			l, err := net.Listen("unix", addr)
 			if err != nil {
-				t.Fatal("failed to listen unix socket")
+				t.Error("failed to listen unix socket")
+				return
 			}
 			ch <- struct{}{}
 			Accept(l)
@@ -86,3 +105,784 @@ func TestXDial(t *testing.T) {
 		_assert(err == nil, "failed to connect unix socket")
 	}
 }
+
+func TestClient_JsonCodec(t *testing.T) {
+	t.Parallel()
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	t.Run("client", func(t *testing.T) {
+		client, err := XDial("tcp@"+l.Addr().String(), &Option{CodecType: codec.JsonType})
+		_assert(err == nil, "failed to dial with json codec: %v", err)
+		defer func() { _ = client.Close() }()
+		var reply int
+		err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "failed to call Foo.Sum with json codec")
+		err = client.Call(context.Background(), "Foo.Missing", Args{}, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect a method error")
+	})
+	t.Run("plain text", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		defer func() { _ = conn.Close() }()
+		_, _ = io.WriteString(conn, fmt.Sprintf(`{"MagicNumber":%d,"CodecType":"application/json"}`+"\n", MagicNumber))
+		_, _ = io.WriteString(conn, `{"ServiceMethod":"Foo.Sum","Seq":7}`+"\n"+`{"Num1":4,"Num2":5}`+"\n")
+		dec := json.NewDecoder(conn)
+		var hs Handshake
+		var h codec.Header
+		var reply int
+		_assert(dec.Decode(&hs) == nil && hs.Error == "", "failed to read handshake")
+		_assert(dec.Decode(&h) == nil && h.Seq == 7 && h.Error == "", "failed to read json header")
+		_assert(dec.Decode(&reply) == nil && reply == 9, "failed to read json body")
+	})
+}
+
+type GroupCache struct{}
+
+func (g *GroupCache) Get(req *pb.Request, resp *pb.Response) error {
+	if req.GetKey() == "" {
+		return errors.New("empty key")
+	}
+	resp.Value = []byte(req.GetGroup() + "/" + req.GetKey())
+	return nil
+}
+
+func TestClient_ProtobufCodec(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(&GroupCache{})
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.ProtobufType})
+	_assert(err == nil, "failed to dial with protobuf codec: %v", err)
+	defer func() { _ = client.Close() }()
+	resp := &pb.Response{}
+	err = client.Call(context.Background(), "GroupCache.Get", &pb.Request{Group: "scores", Key: "Tom"}, resp)
+	_assert(err == nil && string(resp.GetValue()) == "scores/Tom", "failed to call GroupCache.Get")
+	err = client.Call(context.Background(), "GroupCache.Get", &pb.Request{Group: "scores"}, resp)
+	_assert(err != nil && err.Error() == "empty key", "expect an application error")
+}
+
+func TestClient_Handshake(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	conn, _ := net.Dial("tcp", l.Addr().String())
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(&Option{MagicNumber: MagicNumber, CodecType: "application/unknown"})
+	var hs Handshake
+	_assert(json.NewDecoder(conn).Decode(&hs) == nil, "failed to read handshake")
+	_assert(strings.Contains(hs.Error, "invalid codec type") && len(hs.Codecs) > 0, "expect an invalid codec error")
+
+	_ = codec.Register("application/gob-test", codec.NewGobCodec)
+	_assert(codec.Register("application/gob-test", codec.NewGobCodec) != nil, "expect a duplicate codec error")
+	client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: "application/gob-test"})
+	_assert(err == nil, "failed to dial with registered codec: %v", err)
+	_ = client.Close()
+
+	// the newline after the option is part of the protocol, it's never guessed from the codec's bytes
+	conn, _ = net.Dial("tcp", l.Addr().String())
+	defer func() { _ = conn.Close() }()
+	data, _ := json.Marshal(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType})
+	_, _ = conn.Write(data)
+	_assert(json.NewDecoder(conn).Decode(&hs) == nil && hs.Error == "", "failed to read handshake")
+	_ = codec.NewGobCodec(conn).Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, &Args{Num1: 1, Num2: 2})
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.Copy(ioutil.Discard, conn)
+	_assert(err == nil, "expect the server to close a connection whose option isn't terminated by a newline, got %v", err)
+}
+
+type Waiter struct{ done chan error }
+
+func (w *Waiter) Wait(ctx context.Context, argv int, reply *int) error {
+	select {
+	case <-ctx.Done():
+		w.done <- ctx.Err()
+		return ctx.Err()
+	case <-time.After(time.Second * 2):
+		w.done <- nil
+		return nil
+	}
+}
+
+func TestClient_CallContext(t *testing.T) {
+	t.Parallel()
+	w := &Waiter{done: make(chan error, 1)}
+	server := NewServer()
+	_ = server.Register(w)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	t.Run("deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		defer cancel()
+		var reply int
+		// wait on Done instead of ctx, so only the deadline sent in header can stop the handler
+		call := <-client.goContext(ctx, "Waiter.Wait", 1, &reply, make(chan *Call, 1)).Done
+		_assert(call.Error != nil && strings.Contains(call.Error.Error(), "handle timeout"), "expect a timeout error")
+		_assert(<-w.done == context.DeadlineExceeded, "expect the handler to see the deadline")
+	})
+	t.Run("expired", func(t *testing.T) {
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+		var reply int
+		call := <-client.goContext(ctx, "Waiter.Wait", 1, &reply, make(chan *Call, 1)).Done
+		_assert(errors.Is(call.Error, ErrDeadlineExceeded), "expect a deadline error, got %v", call.Error)
+		select {
+		case <-w.done:
+			_assert(false, "expect the handler not to be called")
+		default:
+		}
+	})
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(time.Millisecond*200, cancel)
+		var reply int
+		err := client.Call(ctx, "Waiter.Wait", 1, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "canceled"), "expect a canceled error")
+		_assert(<-w.done == context.Canceled, "expect the handler to be canceled")
+	})
+}
+
+type Tracer struct{}
+
+func (t Tracer) Trace(ctx context.Context, argv int, reply *string) error {
+	*reply = FromIncomingContext(ctx)["trace-id"]
+	return SetResponseMetadata(ctx, Metadata{"served-by": "tracer"})
+}
+
+// TraceLater keeps setting response metadata after returning
+func (t Tracer) TraceLater(ctx context.Context, argv int, reply *string) error {
+	_ = SetResponseMetadata(ctx, Metadata{"served-by": "tracer"})
+	go func() {
+		for i := 0; i < 100; i++ {
+			_ = SetResponseMetadata(ctx, Metadata{"served-by": "late tracer"})
+		}
+	}()
+	return nil
+}
+
+func TestClient_Metadata(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(Tracer{})
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType} {
+		client, _ := Dial("tcp", l.Addr().String(), &Option{CodecType: typ})
+		var md Metadata
+		ctx := AppendToOutgoingContext(context.Background(), "trace-id", "42")
+		ctx = WithResponseMetadata(ctx, &md)
+		var reply string
+		err := client.Call(ctx, "Tracer.Trace", 1, &reply)
+		_assert(err == nil && reply == "42", "%s: expect the handler to read request metadata", typ)
+		_assert(md["served-by"] == "tracer" && md["trace-id"] == "", "%s: expect response metadata only", typ)
+
+		// run with -race to check the metadata is copied before being sent
+		md = nil
+		err = client.Call(ctx, "Tracer.TraceLater", 1, &reply)
+		_assert(err == nil && md["served-by"] != "", "%s: expect response metadata set before returning", typ)
+		_ = client.Close()
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	t.Parallel()
+	var foo Foo
+	var trace []string
+	var mu sync.Mutex
+	record := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		trace = append(trace, s)
+	}
+	server := NewServer()
+	_ = server.Register(&foo)
+	server.Use(func(ctx context.Context, serviceMethod string, args, reply interface{}, handler UnaryHandler) error {
+		record("server " + serviceMethod)
+		if args.(Args).Num1 < 0 {
+			return errors.New("negative number")
+		}
+		return handler(ctx, args, reply)
+	})
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	client.Use(func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker UnaryInvoker) error {
+		record("client outer")
+		return invoker(ctx, serviceMethod, args, reply)
+	}, func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker UnaryInvoker) error {
+		record("client inner")
+		return invoker(ctx, serviceMethod, args, reply)
+	})
+
+	var reply int
+	err := client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum through interceptors")
+	_assert(strings.Join(trace, ",") == "client outer,client inner,server Foo.Sum", "wrong interceptor order: %v", trace)
+
+	call := <-client.Go("Foo.Sum", Args{Num1: -1, Num2: 2}, &reply, nil).Done
+	_assert(call.Error != nil && call.Error.Error() == "negative number", "expect the server interceptor to reject")
+}
+
+type Panicker int
+
+func (p Panicker) Panic(argv int, reply *int) error {
+	panic("boom")
+}
+
+func TestServer_RecoverPanic(t *testing.T) {
+	t.Parallel()
+	var foo Foo
+	var p Panicker
+	server := NewServer()
+	_ = server.Register(&foo)
+	_ = server.Register(&p)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	var reply int
+	err := client.Call(context.Background(), "Panicker.Panic", 1, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "panic in Panicker.Panic: boom"), "expect a panic error")
+	_assert(!strings.Contains(err.Error(), "goroutine"), "stack shouldn't be sent by default")
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "server should keep working after a panic")
+
+	svc, mtype, _ := server.findService("Panicker.Panic")
+	_assert(svc != nil && mtype.NumPanics() == 1, "expect 1 panic, but got %d", mtype.NumPanics())
+
+	debugServer := NewServer()
+	_ = debugServer.Register(&p)
+	debugServer.SetPanicStack(true)
+	dl, _ := net.Listen("tcp", ":0")
+	go debugServer.Accept(dl)
+	client2, _ := Dial("tcp", dl.Addr().String())
+	defer func() { _ = client2.Close() }()
+	err = client2.Call(context.Background(), "Panicker.Panic", 1, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "goroutine"), "expect the stack in error")
+}
+
+type Sleeper int
+
+func (s Sleeper) Sleep(ms int, reply *int) error {
+	time.Sleep(time.Millisecond * time.Duration(ms))
+	*reply = ms
+	return nil
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	t.Parallel()
+	var s Sleeper
+	server := NewServer()
+	_ = server.Register(&s)
+	var hooked int32
+	server.RegisterOnShutdown(func() { atomic.StoreInt32(&hooked, 1) })
+	l, _ := net.Listen("tcp", ":0")
+	accepted := make(chan struct{})
+	go func() {
+		server.Accept(l)
+		close(accepted)
+	}()
+
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	var reply int
+	call := client.Go("Sleeper.Sleep", 300, &reply, nil)
+	time.Sleep(time.Millisecond * 100)
+
+	err := server.Shutdown(context.Background())
+	_assert(err == nil, "failed to shutdown: %v", err)
+	call = <-call.Done
+	_assert(call.Error == nil && reply == 300, "expect the pending call to be drained")
+	_assert(atomic.LoadInt32(&hooked) == 1, "expect the shutdown hook to be called")
+	_assert(!client.IsAvailable(), "client should be unavailable after shutdown")
+	err = client.Call(context.Background(), "Sleeper.Sleep", 1, &reply)
+	_assert(err == ErrShutdown, "expect ErrShutdown for new calls, but got %v", err)
+	<-accepted
+	_, err = Dial("tcp", l.Addr().String())
+	_assert(err != nil, "expect the listener to be closed")
+
+	t.Run("deadline", func(t *testing.T) {
+		server := NewServer()
+		_ = server.Register(&s)
+		l, _ := net.Listen("tcp", ":0")
+		go server.Accept(l)
+		client, _ := Dial("tcp", l.Addr().String())
+		defer func() { _ = client.Close() }()
+		call := client.Go("Sleeper.Sleep", 1000, &reply, nil)
+		time.Sleep(time.Millisecond * 100)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		_assert(err == context.DeadlineExceeded, "expect the deadline to be exceeded")
+		call = <-call.Done
+		_assert(call.Error != nil, "expect the pending call to fail after connections are closed")
+	})
+}
+
+type Counter int
+
+func (c Counter) Count(n int, stream ServerStream) error {
+	for i := 0; i < n; i++ {
+		if err := stream.Send(&i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Counter) Sum(first int, stream ServerStream) error {
+	sum := first
+	for {
+		var n int
+		err := stream.Recv(&n)
+		if err == io.EOF {
+			return stream.Send(&sum)
+		}
+		if err != nil {
+			return err
+		}
+		sum += n
+	}
+}
+
+func (c Counter) Block(n int, stream ServerStream) error {
+	<-stream.Context().Done()
+	return stream.Context().Err()
+}
+
+func TestClient_Stream(t *testing.T) {
+	t.Parallel()
+	var c Counter
+	server := NewServer()
+	_ = server.Register(&c)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	t.Run("server stream", func(t *testing.T) {
+		var n int
+		stream, err := client.NewStream(context.Background(), "Counter.Count", 500, &n)
+		_assert(err == nil, "failed to open stream: %v", err)
+		var got int
+		for ; ; got++ {
+			if err = stream.Recv(&n); err != nil {
+				break
+			}
+			_assert(n == got, "expect %d, but got %d", got, n)
+		}
+		_assert(err == io.EOF && got == 500, "expect 500 messages and io.EOF, but got %d, %v", got, err)
+	})
+	t.Run("client stream", func(t *testing.T) {
+		var sum int
+		stream, _ := client.NewStream(context.Background(), "Counter.Sum", 1, &sum)
+		for i := 2; i <= 200; i++ {
+			_assert(stream.Send(&i) == nil, "failed to send %d", i)
+		}
+		_ = stream.CloseSend()
+		err := stream.Recv(&sum)
+		_assert(err == nil && sum == 200*201/2, "expect sum 20100, but got %d", sum)
+		_assert(stream.Recv(&sum) == io.EOF, "expect io.EOF at the end of stream")
+	})
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var n int
+		stream, _ := client.NewStream(ctx, "Counter.Block", 1, &n)
+		time.AfterFunc(time.Millisecond*100, cancel)
+		err := stream.Recv(&n)
+		_assert(err == context.Canceled, "expect the stream to be canceled, but got %v", err)
+	})
+	t.Run("unary", func(t *testing.T) {
+		var n int
+		err := client.Call(context.Background(), "Counter.Count", 1, &n)
+		_assert(err != nil && strings.Contains(err.Error(), "can't be called as a unary call"), "expect a stream method error")
+	})
+}
+
+type Echo int
+
+func (e Echo) Echo(s string, reply *string) error {
+	*reply = s
+	return nil
+}
+
+func TestClient_Multiplex(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Echo))
+	_ = server.Register(new(Counter))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType} {
+		client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: typ, Multiplex: true})
+		_assert(err == nil, "failed to dial with multiplexing: %v", err)
+
+		large := strings.Repeat("x", 8<<20)
+		var largeReply string
+		call := client.Go("Echo.Echo", large, &largeReply, make(chan *Call, 1))
+		var reply string
+		err = client.Call(context.Background(), "Echo.Echo", "small", &reply)
+		_assert(err == nil && reply == "small", "failed to call Echo.Echo: %v", err)
+		select {
+		case <-call.Done:
+			t.Errorf("%s: small call is blocked by the large one", typ)
+		default:
+		}
+		<-call.Done
+		_assert(call.Error == nil && largeReply == large, "failed to echo a large message: %v", call.Error)
+
+		stream, err := client.NewStream(context.Background(), "Counter.Count", 3, new(int))
+		_assert(err == nil, "failed to start stream: %v", err)
+		for i := 0; i < 3; i++ {
+			var n int
+			_assert(stream.Recv(&n) == nil && n == i, "failed to receive %d", i)
+		}
+		_ = client.Close()
+	}
+}
+
+// Flood sends messages of size bytes until the stream is canceled
+func (c Counter) Flood(size int, stream ServerStream) error {
+	m := strings.Repeat("x", size)
+	for {
+		if err := stream.Send(&m); err != nil {
+			return err
+		}
+	}
+}
+
+// slowConn delays every write, like a connection slower than its senders
+type slowConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c slowConn) Write(b []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Write(b)
+}
+
+func TestClient_MultiplexFlood(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Echo))
+	_ = server.Register(new(Counter))
+	sconn, cconn := net.Pipe()
+	go server.ServeConn(slowConn{sconn, 2 * time.Millisecond})
+	client, err := NewClient(cconn, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, Multiplex: true})
+	_assert(err == nil, "failed to create client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	// messages of the stream are larger than what may be queued for it,
+	// so the server keeps waiting to send more of them
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var m string
+	stream, err := client.NewStream(ctx, "Counter.Flood", 4<<20, &m)
+	_assert(err == nil, "failed to start stream: %v", err)
+	_assert(stream.Recv(&m) == nil, "failed to receive the flood")
+
+	start := time.Now()
+	var reply string
+	err = client.Call(context.Background(), "Echo.Echo", "small", &reply)
+	_assert(err == nil && reply == "small", "failed to call Echo.Echo: %v", err)
+	_assert(time.Since(start) < 500*time.Millisecond, "expect the unary call not to wait for the stream, took %v", time.Since(start))
+}
+
+// newCert issues a certificate for cn signed by parent, self-signed if parent is nil
+func newCert(cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_assert(err == nil, "failed to generate key: %v", err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	_assert(err == nil, "failed to create certificate: %v", err)
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+type Whoami int
+
+func (w Whoami) Whoami(ctx context.Context, argv int, reply *string) error {
+	p, ok := PeerFromContext(ctx)
+	switch {
+	case ok && p.Principal != "":
+		*reply = p.Principal
+	case ok && p.Identity() != nil:
+		*reply = p.Identity().Subject.CommonName
+	default:
+		return errors.New("unknown client")
+	}
+	return nil
+}
+
+func TestClient_TLS(t *testing.T) {
+	t.Parallel()
+	ca := newCert("test ca", nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{newCert("server", &ca)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	}
+	clientConfig := &tls.Config{
+		Certificates: []tls.Certificate{newCert("alice", &ca)},
+		RootCAs:      roots,
+	}
+	server := NewServer()
+	_ = server.Register(new(Whoami))
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.AcceptTLS(l, serverConfig)
+	addr := l.Addr().String()
+
+	t.Run("tls", func(t *testing.T) {
+		client, err := XDial("tls@"+addr, &Option{TLSConfig: clientConfig})
+		_assert(err == nil, "failed to dial over tls: %v", err)
+		defer func() { _ = client.Close() }()
+		var reply string
+		err = client.Call(context.Background(), "Whoami.Whoami", 0, &reply)
+		_assert(err == nil && reply == "alice", "expect the client identity, got %q %v", reply, err)
+	})
+	t.Run("no client cert", func(t *testing.T) {
+		_, err := XDial("tls@"+addr, &Option{TLSConfig: &tls.Config{RootCAs: roots}})
+		_assert(err != nil, "expect an error without client certificate")
+	})
+	t.Run("untrusted server", func(t *testing.T) {
+		_, err := XDial("tls@"+addr, &Option{TLSConfig: &tls.Config{Certificates: clientConfig.Certificates}})
+		_assert(err != nil, "expect an error for unknown authority")
+	})
+	t.Run("https", func(t *testing.T) {
+		hl, _ := net.Listen("tcp", "127.0.0.1:0")
+		hs := &http.Server{Handler: server, TLSConfig: serverConfig}
+		go func() { _ = hs.ServeTLS(hl, "", "") }()
+		defer func() { _ = hs.Close() }()
+		client, err := XDial("https@"+hl.Addr().String(), &Option{TLSConfig: clientConfig})
+		_assert(err == nil, "failed to dial over https: %v", err)
+		defer func() { _ = client.Close() }()
+		var reply string
+		err = client.Call(context.Background(), "Whoami.Whoami", 0, &reply)
+		_assert(err == nil && reply == "alice", "expect the client identity over https, got %q %v", reply, err)
+	})
+}
+
+func TestServer_Auth(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Whoami))
+	_ = server.Register(new(Echo))
+	server.SetAuthenticator(AuthenticatorFunc(func(p *Peer, authData map[string]string) (string, error) {
+		if authData["token"] != "" {
+			return TokenAuthenticator(map[string]string{"secret": "alice"}).Authenticate(p, authData)
+		}
+		return HMACAuthenticator(map[string][]byte{"bob": []byte("key")}, time.Minute).Authenticate(p, authData)
+	}))
+	server.SetACL(ACL{"Echo.*": {"*"}, "Whoami.Whoami": {"alice"}})
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	addr := l.Addr().String()
+
+	_, err := Dial("tcp", addr, &Option{Credentials: TokenCredentials("wrong")})
+	_assert(errors.Is(err, ErrUnauthenticated), "expect an unauthenticated error, got %v", err)
+	_, err = Dial("tcp", addr, &Option{Credentials: &HMACCredentials{ID: "bob", Key: []byte("wrong")}})
+	_assert(errors.Is(err, ErrUnauthenticated), "expect an unauthenticated error, got %v", err)
+
+	alice, err := Dial("tcp", addr, &Option{Credentials: TokenCredentials("secret")})
+	_assert(err == nil, "failed to dial with token: %v", err)
+	defer func() { _ = alice.Close() }()
+	bob, err := Dial("tcp", addr, &Option{Credentials: &HMACCredentials{ID: "bob", Key: []byte("key")}})
+	_assert(err == nil, "failed to dial with hmac: %v", err)
+	defer func() { _ = bob.Close() }()
+
+	var reply string
+	err = bob.Call(context.Background(), "Echo.Echo", "hi", &reply)
+	_assert(err == nil && reply == "hi", "expect Echo.* allowed to anyone: %v", err)
+	err = alice.Call(context.Background(), "Whoami.Whoami", 0, &reply)
+	_assert(err == nil && reply == "alice", "expect alice allowed to call Whoami.Whoami: %v", err)
+	err = bob.Call(context.Background(), "Whoami.Whoami", 0, &reply)
+	_assert(errors.Is(err, ErrPermissionDenied), "expect a permission denied error, got %v", err)
+}
+
+type Validator int
+
+func (v Validator) Validate(name string, reply *string) error {
+	if name == "" {
+		return Errorf(CodeInvalidArgument, "name is required").WithDetails("field", "name")
+	}
+	if name == "wrapped" {
+		return fmt.Errorf("validating: %w", ErrPermissionDenied)
+	}
+	return errors.New("plain error")
+}
+
+func TestClient_Status(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	_ = server.Register(new(Validator))
+	_ = server.Register(new(Sleeper))
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	client, _ := Dial("tcp", l.Addr().String(), &Option{HandleTimeout: 50 * time.Millisecond})
+	defer func() { _ = client.Close() }()
+
+	var reply string
+	err := client.Call(context.Background(), "Validator.Validate", "", &reply)
+	var s *Status
+	_assert(errors.Is(err, ErrInvalidArgument) && errors.As(err, &s), "expect an invalid argument status, got %v", err)
+	_assert(s.Message == "name is required" && s.Details["field"] == "name", "expect the details of status, got %+v", s)
+
+	err = client.Call(context.Background(), "Validator.Validate", "wrapped", &reply)
+	_assert(errors.Is(err, ErrPermissionDenied) && err.Error() == "validating: rpc: permission denied", "expect a wrapped status, got %v", err)
+	err = client.Call(context.Background(), "Validator.Validate", "x", &reply)
+	_assert(StatusOf(err).Code == CodeUnknown && err.Error() == "plain error", "expect an unknown status, got %v", err)
+	err = client.Call(context.Background(), "Validator.Missing", "x", &reply)
+	_assert(errors.Is(err, ErrMethodNotFound), "expect a method not found status, got %v", err)
+
+	var n int
+	err = client.Call(context.Background(), "Sleeper.Sleep", 200, &n)
+	_assert(errors.Is(err, ErrDeadlineExceeded), "expect a server deadline status, got %v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = client.Call(ctx, "Sleeper.Sleep", 200, &n)
+	_assert(errors.Is(err, ErrDeadlineExceeded) && errors.Is(err, context.DeadlineExceeded), "expect a client deadline status, got %v", err)
+}
+
+func TestClient_Keepalive(t *testing.T) {
+	t.Parallel()
+	// a server that completes the handshake and then never answers, like a half-open connection
+	l, _ := net.Listen("tcp", ":0")
+	defer func() { _ = l.Close() }()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		var opt Option
+		_ = json.NewDecoder(conn).Decode(&opt)
+		_ = json.NewEncoder(conn).Encode(&Handshake{})
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}()
+	client, err := Dial("tcp", l.Addr().String(), &Option{PingInterval: 50 * time.Millisecond, PingTimeout: 50 * time.Millisecond})
+	_assert(err == nil, "failed to dial: %v", err)
+	var reply int
+	call := client.Go("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply, nil)
+	select {
+	case <-call.Done:
+		_assert(errors.Is(call.Error, ErrPingTimeout), "expect a ping timeout, got %v", call.Error)
+	case <-time.After(time.Second):
+		_assert(false, "expect the dead connection to be detected")
+	}
+	_assert(!client.IsAvailable(), "expect client to be unavailable")
+
+	// the server keeps idle connections alive as long as clients answer pings
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	server.SetKeepalive(20*time.Millisecond, 20*time.Millisecond)
+	sl, _ := net.Listen("tcp", ":0")
+	go server.Accept(sl)
+	client, _ = Dial("tcp", sl.Addr().String())
+	defer func() { _ = client.Close() }()
+	time.Sleep(150 * time.Millisecond)
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3 && client.IsAvailable(), "expect idle connection to stay alive: %v", err)
+
+	// and closes the connections of clients that don't
+	conn, _ := net.Dial("tcp", sl.Addr().String())
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(DefaultOption)
+	var hs Handshake
+	_ = json.NewDecoder(conn).Decode(&hs)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.Copy(ioutil.Discard, conn)
+	_assert(err == nil, "expect server to close the silent connection, got %v", err)
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	t.Parallel()
+	var s Sleeper
+	server := NewServer()
+	_ = server.Register(&s)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	go server.Accept(l)
+	client, err := Dial("tcp", addr, &Option{Reconnect: &ReconnectPolicy{InitialBackoff: 20 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Multiplier: 2}})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	call := client.Go("Sleeper.Sleep", 1000, &reply, nil)
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_ = server.Shutdown(ctx)
+	call = <-call.Done
+	_assert(call.Error != nil, "expect the call in flight to fail")
+	_assert(client.Call(context.Background(), "Sleeper.Sleep", 1, &reply) == ErrShutdown, "expect ErrShutdown while reconnecting")
+
+	// the server comes back at the same address
+	server = NewServer()
+	_ = server.Register(&s)
+	l, err = net.Listen("tcp", addr)
+	_assert(err == nil, "failed to listen again: %v", err)
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	for i := 0; i < 100 && !client.IsAvailable(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_assert(client.IsAvailable(), "expect client to reconnect")
+	err = client.Call(context.Background(), "Sleeper.Sleep", 1, &reply)
+	_assert(err == nil && reply == 1, "expect calls to resume after reconnect: %v", err)
+
+	_ = client.Close()
+	err = client.Call(context.Background(), "Sleeper.Sleep", 1, &reply)
+	_assert(err == ErrShutdown, "expect closed client not to reconnect, got %v", err)
+
+	t.Run("attempts", func(t *testing.T) {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		go NewServer().Accept(l)
+		client, _ := Dial("tcp", l.Addr().String(), &Option{Reconnect: &ReconnectPolicy{InitialBackoff: time.Millisecond, MaxAttempts: 2}})
+		defer func() { _ = client.Close() }()
+		_ = l.Close()
+		client.mu.Lock()
+		_ = client.cc.Close()
+		client.mu.Unlock()
+		for i := 0; i < 100; i++ {
+			client.mu.Lock()
+			shutdown := client.shutdown
+			client.mu.Unlock()
+			if shutdown {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		_assert(false, "expect client to give up after MaxAttempts")
+	})
+}
@@ -1,13 +1,28 @@
 package codec
 
 import (
+	"errors"
 	"io"
+	"sort"
+	"sync"
+	"time"
 )
 
 type Header struct {
 	ServiceMethod string // format "Service.Method"
 	Seq           uint64 // sequence number chosen by client
 	Error         string
+	Timeout       time.Duration // time left before the caller's deadline, 0 means no limit
+	Cancel        bool          // caller has given up the call of Seq
+	Metadata      map[string]string
+	GoAway        bool              // server is shutting down, don't send new calls
+	Stream        bool              // message belongs to the stream of Seq
+	EOS           bool              // end of stream, sender has no more messages
+	Credit        uint32            // receiver of the stream can accept Credit more messages
+	Code          uint32            // error code of Error, 0 means unknown
+	Details       map[string]string // optional details of Error
+	Ping          bool              // peer checks the connection is alive, answer with Pong
+	Pong          bool              // answer of Ping
 }
 
 type Codec interface {
@@ -22,13 +37,53 @@ type NewCodecFunc func(io.ReadWriteCloser) Codec
 type Type string
 
 const (
-	GobType  Type = "application/gob"
-	JsonType Type = "application/json" // not implemented
+	GobType      Type = "application/gob"
+	JsonType     Type = "application/json"
+	ProtobufType Type = "application/protobuf"
 )
 
-var NewCodecFuncMap map[Type]NewCodecFunc
+var (
+	mu     sync.RWMutex // protect following
+	codecs = make(map[Type]NewCodecFunc)
+)
 
 func init() {
-	NewCodecFuncMap = make(map[Type]NewCodecFunc)
-	NewCodecFuncMap[GobType] = NewGobCodec
+	_ = Register(GobType, NewGobCodec)
+	_ = Register(JsonType, NewJsonCodec)
+	_ = Register(ProtobufType, NewProtobufCodec)
+}
+
+// Register makes a codec available under the given type,
+// it returns an error if the type is empty or already registered.
+func Register(typ Type, f NewCodecFunc) error {
+	if typ == "" || f == nil {
+		return errors.New("codec: register with empty type or nil NewCodecFunc")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := codecs[typ]; dup {
+		return errors.New("codec: codec already registered: " + string(typ))
+	}
+	codecs[typ] = f
+	return nil
+}
+
+// Lookup returns the NewCodecFunc registered for typ
+func Lookup(typ Type) (NewCodecFunc, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	f, ok := codecs[typ]
+	return f, ok
+}
+
+// Types returns all registered codec types in sorted order
+func Types() []Type {
+	mu.RLock()
+	defer mu.RUnlock()
+	types := make([]Type, 0, len(codecs))
+	for typ := range codecs {
+		types = append(types, typ)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
 }
@@ -0,0 +1,374 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// maxChunkSize is the largest payload of a single frame,
+// messages larger than it are split into several frames.
+const maxChunkSize = 16 << 10
+
+const (
+	maxQueued    = 1 << 20         // bytes queued for a seq before WaitWritable blocks
+	drainTimeout = 5 * time.Second // default of how long Close waits for queued frames to be sent
+)
+
+// flags of a frame
+const (
+	lastChunk byte = 1 << iota // last frame of a message
+	typeChunk                  // frame of gob type definitions, see splitGobTypes
+)
+
+// FramedCodec multiplexes messages of different Seq over a connection.
+// Messages (header and body) are encoded by an inner codec kept for the
+// whole connection, then split into frames of
+//
+//	| seq uvarint | flags byte | length uvarint | payload |
+//
+// Frames of different Seq are interleaved by a background writer, so a large
+// message doesn't block small ones behind it, while messages of the same Seq
+// keep their order. Write only queues the message and returns, WaitWritable
+// blocks while earlier messages of the same Seq, e.g. of a stream, have more
+// than maxQueued bytes left to send.
+//
+// A gob encoder sends the definition of a type only once, so definitions
+// are sent in frames of their own ahead of any message, which makes them
+// known to the reader before the messages needing them, whatever order
+// the messages are completed in.
+type FramedCodec struct {
+	conn         io.ReadWriteCloser
+	newCodec     NewCodecFunc
+	gob          bool          // inner codec is gob, whose type definitions are split from messages
+	drainTimeout time.Duration // how long Close waits for queued frames to be sent
+
+	// reading side, used by a single goroutine
+	r       *bufio.Reader
+	partial map[uint64]*bytes.Buffer // messages being reassembled
+	types   bytes.Buffer             // gob type definitions not decoded yet
+	in      bytes.Buffer             // input of dec
+	dec     Codec                    // inner gob codec decoding every message
+	cur     Codec                    // inner codec of the message being read
+
+	// encoding side
+	encMu sync.Mutex // serialize encoding, so that messages are queued in encoding order
+	out   bytes.Buffer
+	enc   Codec // inner codec encoding every message to out
+
+	// writing side
+	buf       *bufio.Writer
+	mu        sync.Mutex            // protect following
+	ready     *sync.Cond            // signaled when frames are queued or closing
+	space     *sync.Cond            // signaled when queued frames are sent
+	queues    map[uint64]*sendQueue // messages waiting to be sent, by seq
+	order     []uint64              // seqs having messages queued, in round-robin order
+	typeQueue [][]byte              // gob type definitions waiting to be sent, before any message
+	err       error                 // error that stopped the writer, or ErrClosedPipe once closing
+	closing   bool
+	done      chan struct{} // closed when the writer returns
+}
+
+// Throttler is implemented by codecs queuing messages, like FramedCodec.
+// WaitWritable blocks until a message of seq can be queued, Write doesn't wait
+// for it, so that a caller serializing the writes of several seqs can wait
+// before taking its lock, and a seq sending faster than the connection
+// doesn't hold up the others.
+type Throttler interface {
+	WaitWritable(seq uint64) error
+}
+
+var (
+	_ Codec     = (*FramedCodec)(nil)
+	_ Throttler = (*FramedCodec)(nil)
+)
+
+// NewFramedCodec returns a FramedCodec encoding messages with newCodec
+func NewFramedCodec(conn io.ReadWriteCloser, newCodec NewCodecFunc) Codec {
+	c := &FramedCodec{
+		conn:         conn,
+		newCodec:     newCodec,
+		drainTimeout: drainTimeout,
+		r:            bufio.NewReader(conn),
+		partial:      make(map[uint64]*bytes.Buffer),
+		buf:          bufio.NewWriter(conn),
+		queues:       make(map[uint64]*sendQueue),
+		done:         make(chan struct{}),
+	}
+	c.enc = newCodec(bufferConn{&c.out})
+	if _, c.gob = c.enc.(*GobCodec); c.gob {
+		c.dec = newCodec(bufferConn{&c.in})
+	}
+	c.ready = sync.NewCond(&c.mu)
+	c.space = sync.NewCond(&c.mu)
+	go c.writeLoop()
+	return c
+}
+
+// sendQueue is the encoded messages of a seq waiting to be sent
+type sendQueue struct {
+	msgs [][]byte
+	size int // bytes left to send
+}
+
+// bufferConn lets an inner codec encode to or decode from memory
+type bufferConn struct {
+	*bytes.Buffer
+}
+
+func (bufferConn) Close() error { return nil }
+
+func (c *FramedCodec) ReadHeader(h *Header) error {
+	for {
+		seq, flags, payload, err := c.readFrame()
+		if err != nil {
+			return err
+		}
+		if flags&typeChunk != 0 {
+			if c.types.Len()+len(payload) > maxFrameSize {
+				return errors.New("rpc: framed codec: type definitions exceed limit")
+			}
+			c.types.Write(payload)
+			continue
+		}
+		msg := c.partial[seq]
+		if msg == nil {
+			msg = new(bytes.Buffer)
+			c.partial[seq] = msg
+		}
+		if msg.Len()+len(payload) > maxFrameSize {
+			return fmt.Errorf("rpc: framed codec: message of seq %d exceeds limit", seq)
+		}
+		msg.Write(payload)
+		if flags&lastChunk == 0 {
+			continue
+		}
+		delete(c.partial, seq)
+		if !c.gob {
+			c.cur = c.newCodec(bufferConn{msg})
+			return c.cur.ReadHeader(h)
+		}
+		// drop what is left of the previous message if its body wasn't read,
+		// the type definitions received so far come before the message
+		c.in.Reset()
+		c.in.Write(c.types.Bytes())
+		c.types.Reset()
+		c.in.Write(msg.Bytes())
+		c.cur = c.dec
+		return c.cur.ReadHeader(h)
+	}
+}
+
+func (c *FramedCodec) ReadBody(body interface{}) error {
+	if c.cur == nil {
+		return errors.New("rpc: framed codec: ReadBody called before ReadHeader")
+	}
+	return c.cur.ReadBody(body)
+}
+
+func (c *FramedCodec) readFrame() (seq uint64, flags byte, payload []byte, err error) {
+	if seq, err = binary.ReadUvarint(c.r); err != nil {
+		return
+	}
+	if flags, err = c.r.ReadByte(); err != nil {
+		return
+	}
+	size, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return
+	}
+	if size > maxChunkSize {
+		err = fmt.Errorf("rpc: framed codec: frame size %d exceeds limit", size)
+		return
+	}
+	payload = make([]byte, size)
+	_, err = io.ReadFull(c.r, payload)
+	return
+}
+
+// WaitWritable blocks while earlier messages of seq have too many bytes left to send
+func (c *FramedCodec) WaitWritable(seq uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.err == nil && c.queues[seq] != nil && c.queues[seq].size >= maxQueued {
+		c.space.Wait()
+	}
+	return c.err
+}
+
+// Write encodes the message and queues it to be sent by the writer
+func (c *FramedCodec) Write(h *Header, body interface{}) error {
+	c.encMu.Lock()
+	defer c.encMu.Unlock()
+	c.out.Reset()
+	encErr := c.enc.Write(h, body)
+	var types []byte
+	msg := append([]byte(nil), c.out.Bytes()...)
+	if c.gob {
+		types, msg = splitGobTypes(msg)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	if len(types) > 0 {
+		// the encoder won't send them again, even if the message failed to encode
+		c.typeQueue = append(c.typeQueue, types)
+		c.ready.Signal()
+	}
+	if encErr != nil {
+		return encErr
+	}
+	q := c.queues[h.Seq]
+	if q == nil {
+		q = new(sendQueue)
+		c.queues[h.Seq] = q
+		c.order = append(c.order, h.Seq)
+	}
+	q.msgs = append(q.msgs, msg)
+	q.size += len(msg)
+	c.ready.Signal()
+	return nil
+}
+
+// cut takes the next chunk of the first message of queue,
+// it returns the queue left and whether chunk ends the message.
+func cut(queue [][]byte) (chunk []byte, last bool, left [][]byte) {
+	chunk = queue[0]
+	if len(chunk) > maxChunkSize {
+		queue[0] = chunk[maxChunkSize:]
+		return chunk[:maxChunkSize], false, queue
+	}
+	return chunk, true, queue[1:]
+}
+
+// nextChunk takes the next chunk to send, type definitions first,
+// then messages in round-robin order of seq.
+// It returns ok false once closing and everything queued is taken.
+func (c *FramedCodec) nextChunk() (seq uint64, flags byte, chunk []byte, more bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.typeQueue) == 0 && len(c.order) == 0 && !c.closing {
+		c.ready.Wait()
+	}
+	var last bool
+	switch {
+	case len(c.typeQueue) > 0:
+		chunk, last, c.typeQueue = cut(c.typeQueue)
+		flags = typeChunk
+	case len(c.order) > 0:
+		seq, c.order = c.order[0], c.order[1:]
+		q := c.queues[seq]
+		chunk, last, q.msgs = cut(q.msgs)
+		q.size -= len(chunk)
+		if len(q.msgs) > 0 {
+			c.order = append(c.order, seq)
+		} else {
+			delete(c.queues, seq)
+		}
+		c.space.Broadcast()
+	default:
+		return 0, 0, nil, false, false
+	}
+	if last {
+		flags |= lastChunk
+	}
+	return seq, flags, chunk, len(c.typeQueue) > 0 || len(c.order) > 0, true
+}
+
+func (c *FramedCodec) writeLoop() {
+	defer close(c.done)
+	var head [2*binary.MaxVarintLen64 + 1]byte
+	for {
+		seq, flags, chunk, more, ok := c.nextChunk()
+		if !ok {
+			return
+		}
+		n := binary.PutUvarint(head[:], seq)
+		head[n] = flags
+		n++
+		n += binary.PutUvarint(head[n:], uint64(len(chunk)))
+		_, err := c.buf.Write(head[:n])
+		if err == nil {
+			_, err = c.buf.Write(chunk)
+		}
+		if err == nil && !more {
+			err = c.buf.Flush()
+		}
+		if err != nil {
+			log.Println("rpc: framed codec error writing frame:", err)
+			c.mu.Lock()
+			c.err = err
+			c.space.Broadcast()
+			c.mu.Unlock()
+			_ = c.conn.Close()
+			return
+		}
+	}
+}
+
+// Close stops accepting messages, and closes the connection once the
+// messages queued are sent, or after c.drainTimeout if the peer doesn't read them.
+// It may block that long, so callers shouldn't hold locks meanwhile.
+func (c *FramedCodec) Close() error {
+	c.mu.Lock()
+	c.closing = true
+	if c.err == nil {
+		c.err = io.ErrClosedPipe
+	}
+	c.ready.Broadcast()
+	c.space.Broadcast()
+	c.mu.Unlock()
+	t := time.NewTimer(c.drainTimeout)
+	defer t.Stop()
+	select {
+	case <-c.done:
+	case <-t.C:
+	}
+	return c.conn.Close()
+}
+
+// splitGobTypes splits a gob stream into the messages defining types and the
+// messages of values. Every gob message is a uint byte count followed by a
+// type id, which is negative for type definitions.
+func splitGobTypes(b []byte) (types, values []byte) {
+	for len(b) > 0 {
+		count, n := gobUint(b)
+		if n == 0 || count > uint64(len(b)-n) {
+			return types, append(values, b...) // not gob, let the decoder report it
+		}
+		msg := b[:n+int(count)]
+		if id, _ := gobUint(b[n:]); id&1 == 1 {
+			types = append(types, msg...)
+		} else {
+			values = append(values, msg...)
+		}
+		b = b[len(msg):]
+	}
+	return types, values
+}
+
+// gobUint decodes an unsigned integer of gob, it returns the number of bytes read, 0 if malformed
+func gobUint(b []byte) (x uint64, n int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	if b[0] < 0x80 {
+		return uint64(b[0]), 1
+	}
+	n = -int(int8(b[0]))
+	if n > 8 || n >= len(b) {
+		return 0, 0
+	}
+	for _, c := range b[1 : n+1] {
+		x = x<<8 | uint64(c)
+	}
+	return x, n + 1
+}
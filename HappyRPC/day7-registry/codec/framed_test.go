@@ -0,0 +1,154 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+// framedPipe returns two FramedCodecs of newCodec connected to each other
+func framedPipe(newCodec NewCodecFunc) (Codec, Codec) {
+	c1, c2 := net.Pipe()
+	return NewFramedCodec(c1, newCodec), NewFramedCodec(c2, newCodec)
+}
+
+func readMessage(cc Codec) (*Header, string) {
+	var h Header
+	var body string
+	err := cc.ReadHeader(&h)
+	_assert(err == nil, "failed to read header: %v", err)
+	err = cc.ReadBody(&body)
+	_assert(err == nil, "failed to read body: %v", err)
+	return &h, body
+}
+
+func TestFramedCodec(t *testing.T) {
+	t.Parallel()
+	for _, typ := range []Type{GobType, JsonType} {
+		newCodec, _ := Lookup(typ)
+		t.Run(string(typ), func(t *testing.T) {
+			w, r := framedPipe(newCodec)
+			defer func() { _ = w.Close() }()
+			defer func() { _ = r.Close() }()
+
+			// a message larger than a frame is split and reassembled
+			large := strings.Repeat("x", 3*maxChunkSize+1)
+			go func() { _ = w.Write(&Header{Seq: 1}, large) }()
+			h, body := readMessage(r)
+			_assert(h.Seq == 1 && body == large, "expect the large message reassembled")
+
+			// a small message isn't blocked behind a large one
+			go func() {
+				_ = w.Write(&Header{Seq: 2}, large)
+				_ = w.Write(&Header{Seq: 3}, "small")
+				_ = w.Write(&Header{Seq: 3, EOS: true}, "end")
+			}()
+			var seqs []uint64
+			for i := 0; i < 3; i++ {
+				h, body := readMessage(r)
+				seqs = append(seqs, h.Seq)
+				if h.Seq == 3 && !h.EOS {
+					_assert(body == "small", "expect the small message")
+				}
+			}
+			_assert(fmt.Sprint(seqs) == "[3 3 2]", "expect messages of seq 3 in order before the large one, got %v", seqs)
+		})
+	}
+}
+
+func TestFramedCodec_GobTypes(t *testing.T) {
+	t.Parallel()
+	w, r := framedPipe(NewGobCodec)
+	defer func() { _ = w.Close() }()
+	defer func() { _ = r.Close() }()
+	type Point struct{ X, Y int }
+
+	// the definition of Point is sent once, ahead of the large message
+	// that needs it, so the following messages can be decoded first
+	large := make([]Point, maxChunkSize)
+	go func() {
+		_ = w.Write(&Header{Seq: 1}, large)
+		_ = w.Write(&Header{Seq: 2}, []Point{{1, 2}})
+	}()
+	for i := 0; i < 2; i++ {
+		var h Header
+		var points []Point
+		_assert(r.ReadHeader(&h) == nil && r.ReadBody(&points) == nil, "failed to read message %d", i)
+		switch h.Seq {
+		case 1:
+			_assert(i == 1 && len(points) == len(large), "expect the large message last")
+		case 2:
+			_assert(i == 0 && points[0] == Point{1, 2}, "expect the small message first")
+		}
+	}
+
+	var out bytes.Buffer
+	enc := NewGobCodec(bufferConn{&out})
+	for i := 0; i < 2; i++ {
+		out.Reset()
+		_ = enc.Write(&Header{Seq: uint64(i)}, Point{1, 2})
+		types, values := splitGobTypes(out.Bytes())
+		_assert((len(types) > 0) == (i == 0) && len(values) > 0, "expect types defined by the first message only")
+	}
+}
+
+func TestFramedCodec_Backpressure(t *testing.T) {
+	t.Parallel()
+	w, r := framedPipe(NewGobCodec)
+	defer func() { _ = w.Close() }()
+	defer func() { _ = r.Close() }()
+	fc := w.(*FramedCodec)
+	large := strings.Repeat("x", 2*maxQueued)
+	_assert(w.Write(&Header{Seq: 1}, large) == nil, "failed to write")
+	writable := make(chan error, 1)
+	go func() { writable <- fc.WaitWritable(1) }()
+	_assert(fc.WaitWritable(2) == nil && w.Write(&Header{Seq: 2}, "other") == nil, "expect messages of other seqs not to wait")
+	select {
+	case <-writable:
+		_assert(false, "expect WaitWritable to wait while the seq has too many bytes queued")
+	case <-time.After(50 * time.Millisecond):
+	}
+	for i := 0; i < 2; i++ {
+		readMessage(r)
+	}
+	_assert(<-writable == nil, "expect WaitWritable to return once the queued bytes are sent")
+}
+
+func TestFramedCodec_Close(t *testing.T) {
+	t.Parallel()
+	w, r := framedPipe(NewGobCodec)
+	defer func() { _ = r.Close() }()
+	large := strings.Repeat("x", 3*maxChunkSize)
+	for seq := uint64(0); seq < 3; seq++ {
+		_assert(w.Write(&Header{Seq: seq}, large) == nil, "failed to write")
+	}
+	done := make(chan error, 1)
+	go func() { done <- w.Close() }()
+	// messages queued before Close are still delivered
+	for seq := 0; seq < 3; seq++ {
+		_, body := readMessage(r)
+		_assert(body == large, "expect the queued message %d", seq)
+	}
+	<-done
+	_assert(w.Write(&Header{}, "late") != nil, "expect Write to fail once closed")
+	var h Header
+	_assert(r.ReadHeader(&h) != nil, "expect the connection closed once drained")
+
+	// Close gives up draining once the peer stops reading
+	w, r = framedPipe(NewGobCodec)
+	defer func() { _ = r.Close() }()
+	w.(*FramedCodec).drainTimeout = 100 * time.Millisecond
+	_ = w.Write(&Header{}, large)
+	start := time.Now()
+	_ = w.Close()
+	_assert(time.Since(start) >= 100*time.Millisecond, "expect Close to wait for the writer")
+}
@@ -0,0 +1,62 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+)
+
+type JsonCodec struct {
+	conn io.ReadWriteCloser
+	buf  *bufio.Writer
+	dec  *json.Decoder
+	enc  *json.Encoder
+}
+
+var _ Codec = (*JsonCodec)(nil)
+
+func NewJsonCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+	return &JsonCodec{
+		conn: conn,
+		buf:  buf,
+		dec:  json.NewDecoder(conn),
+		enc:  json.NewEncoder(buf),
+	}
+}
+
+func (c *JsonCodec) ReadHeader(h *Header) error {
+	return c.dec.Decode(h)
+}
+
+func (c *JsonCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		// json can't decode into nil like gob does, so discard the body explicitly
+		var discard json.RawMessage
+		return c.dec.Decode(&discard)
+	}
+	return c.dec.Decode(body)
+}
+
+func (c *JsonCodec) Write(h *Header, body interface{}) (err error) {
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	if err = c.enc.Encode(h); err != nil {
+		log.Println("rpc: json error encoding header:", err)
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		log.Println("rpc: json error encoding body:", err)
+		return
+	}
+	return
+}
+
+func (c *JsonCodec) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,304 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxFrameSize limits a single length-prefixed protobuf frame
+const maxFrameSize = 64 << 20
+
+// ProtobufCodec writes every header and body as a uvarint length followed by
+// the protobuf encoding. Header is encoded as the following message:
+//
+//	message Header {
+//	  string service_method = 1;
+//	  uint64 seq = 2;
+//	  string error = 3;
+//	  int64 timeout = 4;
+//	  bool cancel = 5;
+//	  map<string, string> metadata = 6;
+//	  bool go_away = 7;
+//	  bool stream = 8;
+//	  bool eos = 9;
+//	  uint32 credit = 10;
+//	  uint32 code = 11;
+//	  map<string, string> details = 12;
+//	  bool ping = 13;
+//	  bool pong = 14;
+//	}
+//
+// Bodies must be proto.Message, so registered methods should use generated
+// message types as argument and reply, e.g. geecachepb.Request/Response.
+type ProtobufCodec struct {
+	conn io.ReadWriteCloser
+	buf  *bufio.Writer
+	r    *bufio.Reader
+}
+
+var _ Codec = (*ProtobufCodec)(nil)
+
+func NewProtobufCodec(conn io.ReadWriteCloser) Codec {
+	return &ProtobufCodec{
+		conn: conn,
+		buf:  bufio.NewWriter(conn),
+		r:    bufio.NewReader(conn),
+	}
+}
+
+func (c *ProtobufCodec) ReadHeader(h *Header) error {
+	data, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	return unmarshalHeader(data, h)
+}
+
+func (c *ProtobufCodec) ReadBody(body interface{}) error {
+	data, err := c.readFrame()
+	if err != nil || body == nil {
+		return err
+	}
+	msg, ok := body.(proto.Message)
+	if !ok {
+		return fmt.Errorf("rpc: protobuf codec: %T is not a proto.Message", body)
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+func (c *ProtobufCodec) Write(h *Header, body interface{}) (err error) {
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	if err = c.writeFrame(marshalHeader(h)); err != nil {
+		log.Println("rpc: protobuf error encoding header:", err)
+		return
+	}
+	var data []byte
+	switch msg := body.(type) {
+	case proto.Message:
+		if data, err = proto.Marshal(msg); err != nil {
+			log.Println("rpc: protobuf error encoding body:", err)
+			return
+		}
+	case nil, struct{}:
+		// placeholder body of error responses and cancel requests, send it as an empty message
+	default:
+		err = fmt.Errorf("rpc: protobuf codec: %T is not a proto.Message", body)
+		log.Println("rpc: protobuf error encoding body:", err)
+		return
+	}
+	if err = c.writeFrame(data); err != nil {
+		log.Println("rpc: protobuf error encoding body:", err)
+	}
+	return
+}
+
+func (c *ProtobufCodec) Close() error {
+	return c.conn.Close()
+}
+
+func (c *ProtobufCodec) readFrame() ([]byte, error) {
+	size, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("rpc: protobuf codec: frame size %d exceeds limit", size)
+	}
+	data := make([]byte, size)
+	if _, err = io.ReadFull(c.r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *ProtobufCodec) writeFrame(data []byte) error {
+	if _, err := c.buf.Write(protowire.AppendVarint(nil, uint64(len(data)))); err != nil {
+		return err
+	}
+	_, err := c.buf.Write(data)
+	return err
+}
+
+func marshalHeader(h *Header) []byte {
+	var b []byte
+	if h.ServiceMethod != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, h.ServiceMethod)
+	}
+	if h.Seq != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, h.Seq)
+	}
+	if h.Error != "" {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, h.Error)
+	}
+	if h.Timeout != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Timeout))
+	}
+	if h.Cancel {
+		b = protowire.AppendTag(b, 5, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(h.Cancel))
+	}
+	if h.GoAway {
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(h.GoAway))
+	}
+	if h.Stream {
+		b = protowire.AppendTag(b, 8, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(h.Stream))
+	}
+	if h.EOS {
+		b = protowire.AppendTag(b, 9, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(h.EOS))
+	}
+	if h.Credit != 0 {
+		b = protowire.AppendTag(b, 10, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Credit))
+	}
+	if h.Code != 0 {
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Code))
+	}
+	if h.Ping {
+		b = protowire.AppendTag(b, 13, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(h.Ping))
+	}
+	if h.Pong {
+		b = protowire.AppendTag(b, 14, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(h.Pong))
+	}
+	b = appendMap(b, 6, h.Metadata)
+	b = appendMap(b, 12, h.Details)
+	return b
+}
+
+func appendMap(b []byte, num protowire.Number, m map[string]string) []byte {
+	for k, v := range m {
+		// map entries are encoded as messages of key = 1 and value = 2
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, v)
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+func unmarshalMapEntry(b []byte) (key, value string, err error) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			key, n = protowire.ConsumeString(b)
+		case num == 2 && typ == protowire.BytesType:
+			value, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return key, value, nil
+}
+
+func unmarshalHeader(b []byte, h *Header) error {
+	*h = Header{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			h.ServiceMethod, n = protowire.ConsumeString(b)
+		case num == 2 && typ == protowire.VarintType:
+			h.Seq, n = protowire.ConsumeVarint(b)
+		case num == 3 && typ == protowire.BytesType:
+			h.Error, n = protowire.ConsumeString(b)
+		case num == 4 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Timeout = time.Duration(v)
+		case num == 5 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Cancel = protowire.DecodeBool(v)
+		case (num == 6 || num == 12) && typ == protowire.BytesType:
+			var entry []byte
+			if entry, n = protowire.ConsumeBytes(b); n < 0 {
+				break
+			}
+			k, v, err := unmarshalMapEntry(entry)
+			if err != nil {
+				return err
+			}
+			m := &h.Metadata
+			if num == 12 {
+				m = &h.Details
+			}
+			if *m == nil {
+				*m = make(map[string]string)
+			}
+			(*m)[k] = v
+		case num == 7 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.GoAway = protowire.DecodeBool(v)
+		case num == 8 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Stream = protowire.DecodeBool(v)
+		case num == 9 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.EOS = protowire.DecodeBool(v)
+		case num == 10 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Credit = uint32(v)
+		case num == 11 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Code = uint32(v)
+		case num == 13 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Ping = protowire.DecodeBool(v)
+		case num == 14 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Pong = protowire.DecodeBool(v)
+		default:
+			// skip unknown fields so newer peers can add to the header
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
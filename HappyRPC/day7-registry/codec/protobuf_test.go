@@ -0,0 +1,66 @@
+package codec
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func fullHeader() Header {
+	return Header{
+		ServiceMethod: "Foo.Sum",
+		Seq:           1 << 40,
+		Error:         "failed",
+		Timeout:       3 * time.Second,
+		Cancel:        true,
+		Metadata:      map[string]string{"trace-id": "42", "tenant": ""},
+		GoAway:        true,
+		Stream:        true,
+		EOS:           true,
+		Credit:        32,
+		Code:          7,
+		Details:       map[string]string{"field": "name"},
+		Ping:          true,
+		Pong:          true,
+	}
+}
+
+func TestProtobufHeader(t *testing.T) {
+	t.Parallel()
+	h := fullHeader()
+	v := reflect.ValueOf(h)
+	for i := 0; i < v.NumField(); i++ {
+		_assert(!v.Field(i).IsZero(), "expect %s set, add new fields to the test", v.Type().Field(i).Name)
+	}
+	var got Header
+	_assert(unmarshalHeader(marshalHeader(&h), &got) == nil, "failed to unmarshal header")
+	_assert(reflect.DeepEqual(got, h), "expect %+v, but got %+v", h, got)
+
+	// a zero header is encoded as nothing
+	_assert(len(marshalHeader(&Header{})) == 0, "expect an empty zero header")
+	_assert(unmarshalHeader(nil, &got) == nil && reflect.DeepEqual(got, Header{}), "expect the header reset")
+}
+
+func TestProtobufHeader_UnknownFields(t *testing.T) {
+	t.Parallel()
+	h := fullHeader()
+	var b []byte
+	b = protowire.AppendTag(b, 99, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1)
+	b = append(b, marshalHeader(&h)...)
+	b = protowire.AppendTag(b, 100, protowire.BytesType)
+	b = protowire.AppendString(b, "from a newer peer")
+	b = protowire.AppendTag(b, 101, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, 1)
+	// a known number of another wire type is skipped too
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, "not a seq")
+
+	var got Header
+	_assert(unmarshalHeader(b, &got) == nil, "expect unknown fields skipped")
+	_assert(reflect.DeepEqual(got, h), "expect %+v, but got %+v", h, got)
+
+	_assert(unmarshalHeader(b[:len(b)-1], &got) != nil, "expect an error on a truncated header")
+}
@@ -18,11 +18,12 @@ const debugText = `<html>
 	Service {{.Name}}
 	<hr>
 		<table>
-		<th align=center>Method</th><th align=center>Calls</th>
+		<th align=center>Method</th><th align=center>Calls</th><th align=center>Panics</th>
 		{{range $name, $mtype := .Method}}
 			<tr>
 			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
 			<td align=center>{{$mtype.NumCalls}}</td>
+			<td align=center>{{$mtype.NumPanics}}</td>
 			</tr>
 		{{end}}
 		</table>
@@ -0,0 +1,130 @@
+package geerpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geerpc/codec"
+)
+
+// Code classifies the error of a call, it's sent along with the error message
+// so that clients can tell errors apart without matching the message.
+type Code uint32
+
+const (
+	CodeUnknown          Code = iota // application errors and errors without a code
+	CodeUnauthenticated              // the client failed to authenticate
+	CodePermissionDenied             // the client isn't allowed to call the method
+	CodeMethodNotFound               // the service or method isn't registered
+	CodeInvalidArgument              // the request can't be decoded or is malformed
+	CodeDeadlineExceeded             // the call didn't finish before its deadline
+	CodeCanceled                     // the caller gave up the call
+	CodeUnavailable                  // the server is shutting down
+	CodeInternal                     // the service method panicked
+)
+
+var codeNames = [...]string{
+	CodeUnknown:          "Unknown",
+	CodeUnauthenticated:  "Unauthenticated",
+	CodePermissionDenied: "PermissionDenied",
+	CodeMethodNotFound:   "MethodNotFound",
+	CodeInvalidArgument:  "InvalidArgument",
+	CodeDeadlineExceeded: "DeadlineExceeded",
+	CodeCanceled:         "Canceled",
+	CodeUnavailable:      "Unavailable",
+	CodeInternal:         "Internal",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return fmt.Sprintf("Code(%d)", uint32(c))
+}
+
+// Status is an error with a Code, it's sent to the client as is, so service
+// methods may return a Status to give the client a code and details.
+// errors.Is reports whether two errors have the same code, e.g.
+//
+//	errors.Is(err, geerpc.ErrMethodNotFound)
+type Status struct {
+	Code    Code
+	Message string
+	Details map[string]string // optional, e.g. the field of an invalid argument
+}
+
+// Errorf returns a Status of code with a formatted message
+func Errorf(code Code, format string, a ...interface{}) *Status {
+	return &Status{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// WithDetails returns a copy of s with key/value added to its details
+func (s *Status) WithDetails(key, value string) *Status {
+	out := &Status{Code: s.Code, Message: s.Message, Details: Metadata(s.Details).Copy()}
+	if out.Details == nil {
+		out.Details = make(map[string]string)
+	}
+	out.Details[key] = value
+	return out
+}
+
+func (s *Status) Error() string { return s.Message }
+
+func (s *Status) Is(target error) bool {
+	if t, ok := target.(*Status); ok {
+		return t.Code == s.Code
+	}
+	switch target {
+	case context.DeadlineExceeded:
+		return s.Code == CodeDeadlineExceeded
+	case context.Canceled:
+		return s.Code == CodeCanceled
+	}
+	return false
+}
+
+var (
+	// ErrUnauthenticated matches errors of clients rejected by the authenticator
+	ErrUnauthenticated = &Status{Code: CodeUnauthenticated, Message: "rpc: unauthenticated"}
+	// ErrPermissionDenied matches errors of calls rejected by the ACL
+	ErrPermissionDenied = &Status{Code: CodePermissionDenied, Message: "rpc: permission denied"}
+	// ErrMethodNotFound matches errors of calls to unknown services or methods
+	ErrMethodNotFound = &Status{Code: CodeMethodNotFound, Message: "rpc: method not found"}
+	// ErrInvalidArgument matches errors of malformed requests
+	ErrInvalidArgument = &Status{Code: CodeInvalidArgument, Message: "rpc: invalid argument"}
+	// ErrDeadlineExceeded matches errors of calls timed out on the client or the server
+	ErrDeadlineExceeded = &Status{Code: CodeDeadlineExceeded, Message: "rpc: deadline exceeded"}
+	// ErrCanceled matches errors of calls canceled by the caller
+	ErrCanceled = &Status{Code: CodeCanceled, Message: "rpc: canceled"}
+	// ErrInternal matches errors of panicking service methods
+	ErrInternal = &Status{Code: CodeInternal, Message: "rpc: internal error"}
+)
+
+// StatusOf returns the Status of err, errors without a Status have CodeUnknown
+func StatusOf(err error) *Status {
+	var s *Status
+	if errors.As(err, &s) {
+		return s
+	}
+	return &Status{Code: CodeUnknown, Message: err.Error()}
+}
+
+// contextError converts the error of a done context to a Status
+func contextError(prefix string, err error) *Status {
+	code := CodeCanceled
+	if err == context.DeadlineExceeded {
+		code = CodeDeadlineExceeded
+	}
+	return &Status{Code: code, Message: prefix + err.Error()}
+}
+
+// setError sets err as the error of h
+func setError(h *codec.Header, err error) {
+	s := StatusOf(err)
+	h.Error, h.Code, h.Details = err.Error(), uint32(s.Code), s.Details
+}
+
+// newCallError rebuilds the error sent by the server
+func newCallError(h *codec.Header) error {
+	return &Status{Code: Code(h.Code), Message: h.Error, Details: h.Details}
+}
@@ -1,3 +1,10 @@
 module geerpc
 
 go 1.13
+
+require (
+	geecache v0.0.0
+	google.golang.org/protobuf v1.34.2
+)
+
+replace geecache => ../../HappyCache/day7-protobuf/geecache
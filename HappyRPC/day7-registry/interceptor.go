@@ -0,0 +1,40 @@
+package geerpc
+
+import "context"
+
+// UnaryHandler invokes the service method of a request on the server
+type UnaryHandler func(ctx context.Context, args, reply interface{}) error
+
+// UnaryServerInterceptor intercepts the handling of a request on the server.
+// It's responsible for calling handler with the args and reply it's given,
+// e.g. for logging, metrics, auth or rate limiting.
+type UnaryServerInterceptor func(ctx context.Context, serviceMethod string, args, reply interface{}, handler UnaryHandler) error
+
+// UnaryInvoker sends a request and waits for the response on the client
+type UnaryInvoker func(ctx context.Context, serviceMethod string, args, reply interface{}) error
+
+// UnaryClientInterceptor intercepts a call on the client,
+// it's responsible for calling invoker to complete the call.
+type UnaryClientInterceptor func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker UnaryInvoker) error
+
+// chainUnaryServer wraps handler with interceptors, the first one is the outermost.
+func chainUnaryServer(interceptors []UnaryServerInterceptor, serviceMethod string, handler UnaryHandler) UnaryHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, args, reply interface{}) error {
+			return interceptor(ctx, serviceMethod, args, reply, next)
+		}
+	}
+	return handler
+}
+
+// chainUnaryClient wraps invoker with interceptors, the first one is the outermost.
+func chainUnaryClient(interceptors []UnaryClientInterceptor, invoker UnaryInvoker) UnaryInvoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+			return interceptor(ctx, serviceMethod, args, reply, next)
+		}
+	}
+	return invoker
+}
@@ -0,0 +1,84 @@
+package geerpc
+
+import (
+	"errors"
+	"geerpc/codec"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPingTimeout terminates the calls of a connection whose peer didn't answer a ping
+var ErrPingTimeout = errors.New("rpc: ping timeout, connection is dead")
+
+// liveness records when a frame was last received on a connection
+type liveness struct {
+	lastRecv int64 // unix nano, accessed atomically
+}
+
+func (l *liveness) touch() {
+	atomic.StoreInt64(&l.lastRecv, time.Now().UnixNano())
+}
+
+func (l *liveness) since() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&l.lastRecv))
+}
+
+// keepalive pings the peer when nothing has been received for interval, and
+// calls dead if still nothing is received within timeout after the ping.
+// Any frame received counts as an answer. It returns once done is closed.
+func keepalive(l *liveness, interval, timeout time.Duration, ping func() error, dead func(), done <-chan struct{}) {
+	if timeout <= 0 {
+		timeout = interval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		if l.since() < interval {
+			continue
+		}
+		sent := time.Now()
+		// write without blocking the timer, the connection may be stuck
+		go func() { _ = ping() }()
+		select {
+		case <-done:
+			return
+		case <-time.After(timeout):
+		}
+		if l.since() > time.Since(sent) {
+			dead()
+			return
+		}
+	}
+}
+
+// SetKeepalive makes the server ping clients of connections idle for interval,
+// and close the connections not answering within timeout, 0 disables.
+// It should be called before serving.
+func (server *Server) SetKeepalive(interval, timeout time.Duration) {
+	server.pingInterval, server.pingTimeout = interval, timeout
+}
+
+// keepalive pings the server over cc as configured by the client's Option until done is closed.
+// If the server doesn't answer, cc is closed and pending calls fail with ErrPingTimeout.
+func (client *Client) keepalive(cc codec.Codec, done <-chan struct{}) {
+	if client.opt.PingInterval <= 0 {
+		return
+	}
+	ping := func() error {
+		return client.writeFrame(&codec.Header{Ping: true}, invalidRequest)
+	}
+	dead := func() {
+		client.mu.Lock()
+		if client.cc == cc {
+			client.pingErr = ErrPingTimeout
+		}
+		client.mu.Unlock()
+		_ = cc.Close()
+	}
+	go keepalive(&client.alive, client.opt.PingInterval, client.opt.PingTimeout, ping, dead, done)
+}
@@ -39,7 +39,9 @@ func startServer(registryAddr string, wg *sync.WaitGroup) {
 	l, _ := net.Listen("tcp", ":0")
 	server := geerpc.NewServer()
 	_ = server.Register(&foo)
-	registry.Heartbeat(registryAddr, "tcp@"+l.Addr().String(), 0)
+	reg := registry.HeartbeatService(registryAddr, &registry.ServerItem{Service: "Foo", Addr: "tcp@" + l.Addr().String(), TTL: time.Minute}, 0)
+	// stop receiving new calls as soon as the server starts shutting down
+	server.RegisterOnShutdown(func() { _ = reg.Deregister() })
 	wg.Done()
 	server.Accept(l)
 }
@@ -61,9 +63,10 @@ func foo(xc *xclient.XClient, ctx context.Context, typ, serviceMethod string, ar
 }
 
 func call(registry string) {
-	d := xclient.NewGeeRegistryDiscovery(registry, 0)
+	d := xclient.NewGeeServiceDiscovery(registry, "Foo", 0)
 	xc := xclient.NewXClient(d, xclient.RandomSelect, nil)
 	defer func() { _ = xc.Close() }()
+	defer func() { _ = d.Close() }()
 	// send request & receive response
 	var wg sync.WaitGroup
 	for i := 0; i < 5; i++ {
@@ -77,9 +80,10 @@ func call(registry string) {
 }
 
 func broadcast(registry string) {
-	d := xclient.NewGeeRegistryDiscovery(registry, 0)
+	d := xclient.NewGeeServiceDiscovery(registry, "Foo", 0)
 	xc := xclient.NewXClient(d, xclient.RandomSelect, nil)
 	defer func() { _ = xc.Close() }()
+	defer func() { _ = d.Close() }()
 	var wg sync.WaitGroup
 	for i := 0; i < 5; i++ {
 		wg.Add(1)
@@ -87,8 +91,9 @@ func broadcast(registry string) {
 			defer wg.Done()
 			foo(xc, context.Background(), "broadcast", "Foo.Sum", &Args{Num1: i, Num2: i * i})
 			// expect 2 - 5 timeout
-			ctx, _ := context.WithTimeout(context.Background(), time.Second*2)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
 			foo(xc, ctx, "broadcast", "Foo.Sleep", &Args{Num1: i, Num2: i * i})
+			cancel()
 		}(i)
 	}
 	wg.Wait()
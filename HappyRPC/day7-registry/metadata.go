@@ -0,0 +1,108 @@
+package geerpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Metadata is a set of key/value pairs sent along with a request or a response,
+// e.g. trace id, tenant id or auth token.
+type Metadata map[string]string
+
+// Copy returns a copy of md
+func (md Metadata) Copy() Metadata {
+	if md == nil {
+		return nil
+	}
+	out := make(Metadata, len(md))
+	for k, v := range md {
+		out[k] = v
+	}
+	return out
+}
+
+type (
+	outgoingKey struct{}
+	incomingKey struct{}
+	responseKey struct{}
+	receivedKey struct{}
+)
+
+// NewOutgoingContext returns a context carrying md,
+// Client.Call sends md to the server along with the request.
+func NewOutgoingContext(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// AppendToOutgoingContext returns a context carrying the outgoing metadata of ctx plus key/value.
+func AppendToOutgoingContext(ctx context.Context, key, value string) context.Context {
+	md := FromOutgoingContext(ctx).Copy()
+	if md == nil {
+		md = make(Metadata)
+	}
+	md[key] = value
+	return NewOutgoingContext(ctx, md)
+}
+
+// FromOutgoingContext returns the metadata the client will send
+func FromOutgoingContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(outgoingKey{}).(Metadata)
+	return md
+}
+
+// FromIncomingContext returns the metadata sent by the client,
+// it's only available in the context passed to a service method.
+func FromIncomingContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(incomingKey{}).(Metadata)
+	return md
+}
+
+// responseMetadata collects the metadata a service method sends back
+type responseMetadata struct {
+	mu sync.Mutex
+	md Metadata
+}
+
+// get returns a copy of the metadata to send, the method may have left
+// goroutines still setting it while the response is encoded.
+func (r *responseMetadata) get() Metadata {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.md.Copy()
+}
+
+func newServerContext(ctx context.Context, md Metadata) (context.Context, *responseMetadata) {
+	resp := new(responseMetadata)
+	ctx = context.WithValue(ctx, incomingKey{}, md)
+	return context.WithValue(ctx, responseKey{}, resp), resp
+}
+
+// SetResponseMetadata adds md to the metadata sent back with the response,
+// ctx must be the context passed to a service method.
+func SetResponseMetadata(ctx context.Context, md Metadata) error {
+	resp, ok := ctx.Value(responseKey{}).(*responseMetadata)
+	if !ok {
+		return errors.New("rpc server: context is not from a service method")
+	}
+	resp.mu.Lock()
+	defer resp.mu.Unlock()
+	if resp.md == nil {
+		resp.md = make(Metadata, len(md))
+	}
+	for k, v := range md {
+		resp.md[k] = v
+	}
+	return nil
+}
+
+// WithResponseMetadata returns a context that makes Client.Call
+// store the metadata sent back by the server into md.
+func WithResponseMetadata(ctx context.Context, md *Metadata) context.Context {
+	return context.WithValue(ctx, receivedKey{}, md)
+}
+
+func responseMetadataFromContext(ctx context.Context) *Metadata {
+	md, _ := ctx.Value(receivedKey{}).(*Metadata)
+	return md
+}
@@ -0,0 +1,83 @@
+package geerpc
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy configures how a client redials its server once the connection is broken.
+// Calls in flight at disconnect time fail, calls made while reconnecting fail with ErrShutdown,
+// and calls made after the connection is back go through it.
+type ReconnectPolicy struct {
+	MaxAttempts    int           // redials per disconnection, 0 means until the client is closed
+	InitialBackoff time.Duration // wait before the first redial
+	MaxBackoff     time.Duration // upper bound of the wait between redials
+	Multiplier     float64       // growth of the wait after each failed redial
+	Jitter         float64       // randomize the wait by ±Jitter, e.g. 0.2 for ±20%
+}
+
+// DefaultReconnectPolicy redials forever, waiting 100ms doubling up to 10s, ±20%
+var DefaultReconnectPolicy = &ReconnectPolicy{
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// backoff returns the wait before the nth redial, n starts with 1
+func (p *ReconnectPolicy) backoff(n int) time.Duration {
+	d := float64(p.InitialBackoff) * math.Pow(math.Max(p.Multiplier, 1), float64(n-1))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(d)
+}
+
+// reconnect fails the calls in flight with err and redials the server
+// as configured by Option.Reconnect. It returns false if the client is
+// closed or the attempts are exhausted.
+func (client *Client) reconnect(err error) bool {
+	client.mu.Lock()
+	if client.closing {
+		client.mu.Unlock()
+		return false
+	}
+	client.reconnecting = true
+	client.mu.Unlock()
+	client.failCalls(err)
+
+	p := client.opt.Reconnect
+	for n := 1; p.MaxAttempts == 0 || n <= p.MaxAttempts; n++ {
+		select {
+		case <-client.closed:
+			return false
+		case <-time.After(p.backoff(n)):
+		}
+		cc, err := client.redial()
+		if err != nil {
+			log.Println("rpc client: reconnect error:", err)
+			continue
+		}
+		client.sending.Lock()
+		client.mu.Lock()
+		if client.closing {
+			client.mu.Unlock()
+			client.sending.Unlock()
+			_ = cc.Close()
+			return false
+		}
+		client.cc, client.done = cc, make(chan struct{})
+		client.reconnecting, client.draining, client.pingErr = false, false, nil
+		client.alive.touch()
+		client.keepalive(cc, client.done)
+		client.mu.Unlock()
+		client.sending.Unlock()
+		return true
+	}
+	return false
+}
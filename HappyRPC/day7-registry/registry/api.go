@@ -0,0 +1,237 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	servicesPath        = "/services"
+	watchPath           = "/watch"
+	defaultWatchTimeout = time.Second * 30
+	requestTimeout      = time.Second * 10 // of the requests of the JSON API, on top of the watch timeout
+)
+
+// ServiceList is the reply of the JSON API listing servers
+type ServiceList struct {
+	Revision uint64        `json:"revision"` // revision of the registry, bumped on every change of any service
+	Servers  []*ServerItem `json:"servers"`
+}
+
+// serveServices serves the JSON API at <registryPath>/services:
+//
+//	GET    ?service=Foo            list the servers of Foo, all servers if service is empty
+//	POST   ServerItem as the body  register the server or keep it alive, reply the ServerItem with its lease
+//	DELETE ?service=Foo&addr=...   deregister the server
+//	DELETE ?lease=N                deregister the server holding the lease
+func (r *GeeRegistry) serveServices(w http.ResponseWriter, req *http.Request) {
+	replicated := req.Header.Get(replicaHeader) != ""
+	switch req.Method {
+	case "GET":
+		revision, items := r.services(req.URL.Query().Get("service"))
+		writeJSON(w, &ServiceList{Revision: revision, Servers: items})
+	case "POST":
+		var item ServerItem
+		if err := json.NewDecoder(req.Body).Decode(&item); err != nil || item.Addr == "" {
+			http.Error(w, "rpc registry: invalid server item", http.StatusBadRequest)
+			return
+		}
+		registered := r.putServer(&item, replicated)
+		if !replicated {
+			r.replicatePut(registered)
+		}
+		writeJSON(w, registered)
+	case "DELETE":
+		query := req.URL.Query()
+		if !replicated {
+			r.replicateDelete(query)
+		}
+		var found bool
+		if lease, err := strconv.ParseUint(query.Get("lease"), 10, 64); err == nil {
+			found = r.revoke(lease)
+		} else {
+			found = r.removeServer(query.Get("service"), query.Get("addr"))
+		}
+		if !found {
+			http.Error(w, "rpc registry: server not found", http.StatusNotFound)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// serveWatch serves GET <registryPath>/watch?service=Foo&revision=N&timeout=30s.
+// It replies like listing the servers of Foo once the revision of the registry
+// is greater than N, or once timeout elapses.
+func (r *GeeRegistry) serveWatch(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	since, _ := strconv.ParseUint(query.Get("revision"), 10, 64)
+	timeout, err := time.ParseDuration(query.Get("timeout"))
+	if err != nil || timeout <= 0 {
+		timeout = defaultWatchTimeout
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+wait:
+	for {
+		r.mu.Lock()
+		revision, changed := r.revision, r.changed
+		r.mu.Unlock()
+		if revision > since {
+			break
+		}
+		select {
+		case <-changed:
+		case <-t.C:
+			break wait
+		case <-req.Context().Done():
+			return
+		}
+	}
+	revision, items := r.services(query.Get("service"))
+	writeJSON(w, &ServiceList{Revision: revision, Servers: items})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// Register registers the server described by item to the registry at the
+// registry URL, e.g. http://localhost:9999/_geerpc_/registry, or keeps it alive.
+// It returns the lease of the registration.
+// registry may be a comma separated list of the URLs of a cluster, which are tried in turn.
+func Register(registry string, item *ServerItem) (uint64, error) {
+	body, err := json.Marshal(item)
+	if err != nil {
+		return 0, err
+	}
+	var registered ServerItem
+	err = failover(registry, func(registry string) error {
+		data, err := do(context.Background(), "POST", registry+servicesPath, body, nil)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, &registered)
+	})
+	return registered.Lease, err
+}
+
+// Deregister removes addr from the servers of service in the registry
+func Deregister(registry, service, addr string) error {
+	query := url.Values{"service": {service}, "addr": {addr}}
+	return failover(registry, func(registry string) error {
+		_, err := do(context.Background(), "DELETE", registry+servicesPath+"?"+query.Encode(), nil, nil)
+		return err
+	})
+}
+
+// Revoke removes the server holding lease from the registry
+func Revoke(registry string, lease uint64) error {
+	query := url.Values{"lease": {strconv.FormatUint(lease, 10)}}
+	return failover(registry, func(registry string) error {
+		_, err := do(context.Background(), "DELETE", registry+servicesPath+"?"+query.Encode(), nil, nil)
+		return err
+	})
+}
+
+// List returns the servers of service registered in the registry, all servers if service is empty
+func List(registry, service string) (list *ServiceList, err error) {
+	query := url.Values{"service": {service}}
+	err = failover(registry, func(registry string) error {
+		list, err = decodeList(do(context.Background(), "GET", registry+servicesPath+"?"+query.Encode(), nil, nil))
+		return err
+	})
+	return list, err
+}
+
+// Watch waits until the revision of the registry is greater than revision or
+// timeout elapses, then returns the servers of service like List.
+// It returns early with ctx's error once ctx is done.
+// The registries of a cluster have their own revisions, so a revision
+// is only meaningful to the registry it was returned by.
+func Watch(ctx context.Context, registry, service string, revision uint64, timeout time.Duration) (list *ServiceList, err error) {
+	if timeout <= 0 {
+		timeout = defaultWatchTimeout
+	}
+	query := url.Values{
+		"service":  {service},
+		"revision": {strconv.FormatUint(revision, 10)},
+		"timeout":  {timeout.String()},
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout+requestTimeout)
+	defer cancel()
+	err = failover(registry, func(registry string) error {
+		list, err = decodeList(do(ctx, "GET", registry+watchPath+"?"+query.Encode(), nil, nil))
+		return err
+	})
+	return list, err
+}
+
+// failover calls f with the URLs of registry in turn until it succeeds,
+// registry is the URL of a registry or a comma separated list of them.
+func failover(registry string, f func(registry string) error) error {
+	var err error
+	for _, u := range strings.Split(registry, ",") {
+		if err = f(strings.TrimSpace(u)); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// do sends a request of the JSON API and returns the body of a successful reply,
+// the request times out after requestTimeout unless ctx has a deadline.
+func do(ctx context.Context, method, rawURL string, body []byte, header http.Header) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("rpc registry: %s %s: %s", method, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+func decodeList(data []byte, err error) (*ServiceList, error) {
+	if err != nil {
+		return nil, err
+	}
+	var list ServiceList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
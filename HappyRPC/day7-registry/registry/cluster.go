@@ -0,0 +1,117 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// replicaHeader marks the requests a registry replicates to its peers,
+// so that they aren't replicated again.
+const replicaHeader = "X-Geerpc-Replica"
+
+// peerQueueSize is how many changes may wait for a peer before they are dropped,
+// the registrations dropped are replicated again by the next heartbeat.
+const peerQueueSize = 1024
+
+// replication is a change of the registrations replicated to the peers
+type replication struct {
+	method string
+	query  string
+	body   []byte
+}
+
+// peer is a registry the changes are replicated to, in the order they are made
+type peer struct {
+	url   string
+	queue chan *replication
+}
+
+// SetPeers makes r a member of a cluster of registries replicating each other,
+// peers are the URLs of the other members, e.g. http://10.0.0.2:9999/_geerpc_/registry.
+// Every registration, heartbeat and deregistration received by a member is sent
+// to the others, and r starts with the registrations of the first peer reachable.
+// It should be called once before serving.
+func (r *GeeRegistry) SetPeers(peers ...string) {
+	r.mu.Lock()
+	for _, u := range peers {
+		p := &peer{url: u, queue: make(chan *replication, peerQueueSize)}
+		r.peers = append(r.peers, p)
+		go r.forward(p)
+	}
+	r.mu.Unlock()
+	go r.syncFrom(peers)
+}
+
+func (r *GeeRegistry) replicate(rep *replication) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range r.peers {
+		select {
+		case p.queue <- rep:
+		default:
+			log.Println("rpc registry: replication queue is full, drop change for", p.url)
+		}
+	}
+}
+
+// replicatePut sends the registration or heartbeat of item to the peers
+func (r *GeeRegistry) replicatePut(item *ServerItem) {
+	body, err := json.Marshal(item)
+	if err != nil {
+		return
+	}
+	r.replicate(&replication{method: "POST", body: body})
+}
+
+// replicateDelete sends the deregistration of the server identified by query to the peers
+func (r *GeeRegistry) replicateDelete(query url.Values) {
+	r.replicate(&replication{method: "DELETE", query: "?" + query.Encode()})
+}
+
+// forward sends the changes queued for p until r is closed
+func (r *GeeRegistry) forward(p *peer) {
+	header := http.Header{replicaHeader: {"1"}}
+	for {
+		select {
+		case <-r.stop:
+			return
+		case rep := <-p.queue:
+			if _, err := do(context.Background(), rep.method, p.url+servicesPath+rep.query, rep.body, header); err != nil {
+				log.Println("rpc registry: replicate to", p.url, "err:", err)
+			}
+		}
+	}
+}
+
+// syncFrom copies the registrations of the first peer reachable that r doesn't have,
+// e.g. after r restarts, they live for their TTL unless they keep sending heartbeats.
+func (r *GeeRegistry) syncFrom(peers []string) {
+	for _, u := range peers {
+		list, err := List(u, "")
+		if err != nil {
+			log.Println("rpc registry: sync from", u, "err:", err)
+			continue
+		}
+		r.mu.Lock()
+		added := false
+		for _, item := range list.Servers {
+			key := serverKey{item.Service, item.Addr}
+			if r.servers[key] != nil {
+				continue
+			}
+			item.start = time.Now()
+			r.servers[key] = item
+			r.scheduleReap(item)
+			added = true
+		}
+		if added {
+			r.notify()
+		}
+		r.mu.Unlock()
+		return
+	}
+}
@@ -3,7 +3,9 @@ package registry
 import (
 	"log"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -11,65 +13,278 @@ import (
 
 // GeeRegistry is a simple register center, provide following functions.
 // add a server and receive heartbeat to keep it alive.
-// returns all alive servers and delete dead servers sync simultaneously.
+// returns all alive servers, and delete dead servers in background once their TTL elapses.
 type GeeRegistry struct {
-	timeout time.Duration
-	mu      sync.Mutex // protect following
-	servers map[string]*ServerItem
+	timeout   time.Duration
+	wake      chan struct{} // wake up the reaper to reschedule
+	stop      chan struct{} // stop the reaper
+	closeOnce sync.Once
+	mu        sync.Mutex // protect following
+	servers   map[serverKey]*ServerItem
+	revision  uint64        // incremented on every change of servers
+	changed   chan struct{} // closed and replaced on every change of servers
+	lease     uint64        // last lease ID granted
+	nextReap  time.Time     // when the reaper will run next
+	peers     []*peer       // registries replicating the registrations, see SetPeers
+}
+
+// serverKey identifies a registration, a server registers once per service
+type serverKey struct {
+	service string
+	addr    string
 }
 
 type ServerItem struct {
-	Addr  string
+	// Service is the name of the service the server serves, e.g. "Foo".
+	// Servers registered without a service serve every service.
+	Service string   `json:"service,omitempty"`
+	Addr    string   `json:"addr"`             // rpcAddr of the server, e.g. tcp@10.0.0.1:9999
+	Weight  int      `json:"weight,omitempty"` // weight for weighted round robin, 0 means the default
+	Version string   `json:"version,omitempty"`
+	Zone    string   `json:"zone,omitempty"`
+	Codec   string   `json:"codec,omitempty"` // codec type of the server, e.g. application/gob
+	Tags    []string `json:"tags,omitempty"`
+	// TTL is how long the registration lives without heartbeat, 0 means the timeout of the registry
+	TTL   time.Duration `json:"ttl,omitempty"`
+	Lease uint64        `json:"lease,omitempty"` // granted by the registry, identifies the registration
 	start time.Time
 }
 
+// sameMetadata reports whether s and item describe the server the same way
+func (s *ServerItem) sameMetadata(item *ServerItem) bool {
+	if s.Weight != item.Weight || s.Version != item.Version || s.Zone != item.Zone ||
+		s.Codec != item.Codec || len(s.Tags) != len(item.Tags) {
+		return false
+	}
+	for i := range s.Tags {
+		if s.Tags[i] != item.Tags[i] {
+			return false
+		}
+	}
+	return true
+}
+
 const (
 	defaultPath    = "/_geerpc_/registry"
 	defaultTimeout = time.Minute * 5
+	maxReapDelay   = time.Minute
 )
 
-// New create a registry instance with timeout setting
+// New create a registry instance with timeout setting, the timeout applies to
+// servers registered without a TTL. A timeout of 0 means they never expire.
 func New(timeout time.Duration) *GeeRegistry {
-	return &GeeRegistry{
-		servers: make(map[string]*ServerItem),
+	r := &GeeRegistry{
+		servers: make(map[serverKey]*ServerItem),
 		timeout: timeout,
+		changed: make(chan struct{}),
+		lease:   uint64(time.Now().UnixNano()),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
 	}
+	go r.reap()
+	return r
+}
+
+// Close stops removing expired servers in background
+func (r *GeeRegistry) Close() error {
+	r.closeOnce.Do(func() { close(r.stop) })
+	return nil
 }
 
 var DefaultGeeRegister = New(defaultTimeout)
 
-func (r *GeeRegistry) putServer(addr string) {
+// notify bumps the revision and wakes up the watchers, r.mu must be held
+func (r *GeeRegistry) notify() {
+	r.revision++
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// ttl returns how long s lives without heartbeat, 0 means forever
+func (r *GeeRegistry) ttl(s *ServerItem) time.Duration {
+	if s.TTL > 0 {
+		return s.TTL
+	}
+	return r.timeout
+}
+
+// putServer registers item or keeps it alive, it returns the registration
+// with its lease. A server keeps its lease as long as it's registered,
+// except that a replicated registration takes the lease granted by the peer.
+func (r *GeeRegistry) putServer(item *ServerItem, replicated bool) *ServerItem {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	s := r.servers[addr]
-	if s == nil {
-		r.servers[addr] = &ServerItem{Addr: addr, start: time.Now()}
-	} else {
-		s.start = time.Now() // if exists, update start time to keep alive
+	key := serverKey{item.Service, item.Addr}
+	s := r.servers[key]
+	if s == nil || !s.sameMetadata(item) {
+		lease := item.Lease
+		if s != nil {
+			lease = s.Lease
+		} else if lease == 0 || r.leased(lease) {
+			r.lease++
+			lease = r.lease
+		}
+		s = new(ServerItem)
+		*s = *item
+		s.Lease = lease
+		r.servers[key] = s
+		r.notify()
+	}
+	if replicated && item.Lease != 0 {
+		s.Lease = item.Lease
+	}
+	s.TTL = item.TTL
+	s.start = time.Now() // if exists, update start time to keep alive
+	r.scheduleReap(s)
+	registered := *s
+	return &registered
+}
+
+// scheduleReap wakes up the reaper if s expires before it runs, r.mu must be held
+func (r *GeeRegistry) scheduleReap(s *ServerItem) {
+	if ttl := r.ttl(s); ttl > 0 && s.start.Add(ttl).Before(r.nextReap) {
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// leased reports whether lease is granted to a server, r.mu must be held
+func (r *GeeRegistry) leased(lease uint64) bool {
+	for _, s := range r.servers {
+		if s.Lease == lease {
+			return true
+		}
+	}
+	return false
+}
+
+// removeServer deregisters addr from service, it returns false if it isn't registered
+func (r *GeeRegistry) removeServer(service, addr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := serverKey{service, addr}
+	if r.servers[key] == nil {
+		return false
+	}
+	delete(r.servers, key)
+	r.notify()
+	return true
+}
+
+// revoke deregisters the server holding lease, it returns false if no server holds it
+func (r *GeeRegistry) revoke(lease uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, s := range r.servers {
+		if s.Lease == lease {
+			delete(r.servers, key)
+			r.notify()
+			return true
+		}
+	}
+	return false
+}
+
+// removeExpired deletes the servers whose heartbeat timed out,
+// and returns when the next server would expire.
+func (r *GeeRegistry) removeExpired() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	next := now.Add(maxReapDelay)
+	removed := false
+	for key, s := range r.servers {
+		ttl := r.ttl(s)
+		if ttl == 0 {
+			continue
+		}
+		expiry := s.start.Add(ttl)
+		if !expiry.After(now) {
+			delete(r.servers, key)
+			removed = true
+		} else if expiry.Before(next) {
+			next = expiry
+		}
+	}
+	if removed {
+		r.notify()
+	}
+	r.nextReap = next
+	return next
+}
+
+// reap removes expired servers in background until the registry is closed
+func (r *GeeRegistry) reap() {
+	for {
+		t := time.NewTimer(time.Until(r.removeExpired()))
+		select {
+		case <-r.stop:
+			t.Stop()
+			return
+		case <-r.wake:
+		case <-t.C:
+		}
+		t.Stop()
 	}
 }
 
-func (r *GeeRegistry) aliveServers() []string {
+// services returns the alive servers of service sorted by address, along with
+// the current revision. An empty service means the servers of all services.
+func (r *GeeRegistry) services(service string) (uint64, []*ServerItem) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	var alive []string
-	for addr, s := range r.servers {
-		if r.timeout == 0 || s.start.Add(r.timeout).After(time.Now()) {
-			alive = append(alive, addr)
-		} else {
-			delete(r.servers, addr)
+	items := make([]*ServerItem, 0, len(r.servers))
+	for key, s := range r.servers {
+		if service == "" || key.service == service || key.service == "" {
+			item := *s
+			items = append(items, &item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Addr != items[j].Addr {
+			return items[i].Addr < items[j].Addr
+		}
+		return items[i].Service < items[j].Service
+	})
+	return r.revision, items
+}
+
+// aliveServers returns the revision of the registry, the addresses
+// of the alive servers, and "addr=weight" of the servers having a weight
+func (r *GeeRegistry) aliveServers() (revision uint64, alive, weights []string) {
+	revision, items := r.services("")
+	for i, s := range items {
+		if i > 0 && items[i-1].Addr == s.Addr {
+			continue // registered for several services
+		}
+		alive = append(alive, s.Addr)
+		if s.Weight > 0 {
+			weights = append(weights, s.Addr+"="+strconv.Itoa(s.Weight))
 		}
 	}
-	sort.Strings(alive)
-	return alive
+	return revision, alive, weights
 }
 
-// Runs at /_geerpc_/registry
+// Runs at /_geerpc_/registry, the JSON API runs at /_geerpc_/registry/services
+// and /_geerpc_/registry/watch, see serveServices and serveWatch.
 func (r *GeeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case strings.HasSuffix(req.URL.Path, servicesPath):
+		r.serveServices(w, req)
+		return
+	case strings.HasSuffix(req.URL.Path, watchPath):
+		r.serveWatch(w, req)
+		return
+	}
 	switch req.Method {
 	case "GET":
 		// keep it simple, server is in req.Header
-		w.Header().Set("X-Geerpc-Servers", strings.Join(r.aliveServers(), ","))
+		revision, alive, weights := r.aliveServers()
+		w.Header().Set("X-Geerpc-Servers", strings.Join(alive, ","))
+		w.Header().Set("X-Geerpc-Weights", strings.Join(weights, ","))
+		w.Header().Set("X-Geerpc-Revision", strconv.FormatUint(revision, 10))
 	case "POST":
 		// keep it simple, server is in req.Header
 		addr := req.Header.Get("X-Geerpc-Server")
@@ -77,7 +292,15 @@ func (r *GeeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		r.putServer(addr)
+		weight, _ := strconv.Atoi(req.Header.Get("X-Geerpc-Weight"))
+		r.replicatePut(r.putServer(&ServerItem{Addr: addr, Weight: weight}, false))
+	case "DELETE":
+		// deregister the server in req.Header
+		addr := req.Header.Get("X-Geerpc-Server")
+		r.replicateDelete(url.Values{"service": {""}, "addr": {addr}})
+		if !r.removeServer("", addr) {
+			w.WriteHeader(http.StatusNotFound)
+		}
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
@@ -86,6 +309,7 @@ func (r *GeeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 // HandleHTTP registers an HTTP handler for GeeRegistry messages on registryPath
 func (r *GeeRegistry) HandleHTTP(registryPath string) {
 	http.Handle(registryPath, r)
+	http.Handle(registryPath+"/", r)
 	log.Println("rpc registry path:", registryPath)
 }
 
@@ -93,33 +317,121 @@ func HandleHTTP() {
 	DefaultGeeRegister.HandleHTTP(defaultPath)
 }
 
+// Registration is a server kept alive in a registry by heartbeats
+type Registration struct {
+	registry     string
+	item         ServerItem
+	stop         chan struct{}
+	mu           sync.Mutex // protect following
+	stopped      bool
+	deregistered bool
+	lease        uint64
+}
+
+// Lease returns the lease granted by the registry, 0 if the server isn't registered yet
+func (reg *Registration) Lease() uint64 {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.lease
+}
+
+// Stop stops sending heartbeats, the server expires once its TTL elapses
+func (reg *Registration) Stop() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if !reg.stopped {
+		reg.stopped = true
+		close(reg.stop)
+	}
+}
+
+// Deregister stops sending heartbeats and removes the server from the registry at once
+func (reg *Registration) Deregister() error {
+	reg.mu.Lock()
+	reg.deregistered = true
+	reg.mu.Unlock()
+	reg.Stop()
+	if lease := reg.Lease(); lease != 0 {
+		return Revoke(reg.registry, lease)
+	}
+	return Deregister(reg.registry, reg.item.Service, reg.item.Addr)
+}
+
+// send sends a heartbeat, the request is made without holding reg.mu
+// so that Stop and Deregister never wait for the registry.
+func (reg *Registration) send() error {
+	reg.mu.Lock()
+	if reg.stopped {
+		reg.mu.Unlock()
+		return nil
+	}
+	item := reg.item
+	item.Lease = reg.lease
+	reg.mu.Unlock()
+	log.Println(item.Addr, "send heart beat to registry", reg.registry)
+	lease, err := Register(reg.registry, &item)
+	if err != nil {
+		log.Println("rpc server: heart beat err:", err)
+		return err
+	}
+	reg.mu.Lock()
+	reg.lease = lease
+	deregistered := reg.deregistered
+	reg.mu.Unlock()
+	if deregistered {
+		// Deregister raced with the heartbeat, which may have registered the server again
+		return Revoke(reg.registry, lease)
+	}
+	return nil
+}
+
 // Heartbeat send a heartbeat message every once in a while
 // it's a helper function for a server to register or send heartbeat
-func Heartbeat(registry, addr string, duration time.Duration) {
-	if duration == 0 {
+func Heartbeat(registry, addr string, duration time.Duration) *Registration {
+	return HeartbeatWeighted(registry, addr, 0, duration)
+}
+
+// HeartbeatWeighted is like Heartbeat, and registers addr with the weight
+// used by clients selecting servers by weighted round robin.
+func HeartbeatWeighted(registry, addr string, weight int, duration time.Duration) *Registration {
+	return HeartbeatService(registry, &ServerItem{Addr: addr, Weight: weight}, duration)
+}
+
+// HeartbeatService is like Heartbeat, and registers the server described by item,
+// e.g. for its service only, along with its metadata and TTL.
+// A duration of 0 sends heartbeats 3 times per TTL.
+func HeartbeatService(registry string, item *ServerItem, duration time.Duration) *Registration {
+	if duration == 0 && item.TTL > 0 {
+		duration = item.TTL / 3
+	} else if duration == 0 {
 		// make sure there is enough time to send heart beat
 		// before it's removed from registry
 		duration = defaultTimeout - time.Duration(1)*time.Minute
 	}
-	var err error
-	err = sendHeartbeat(registry, addr)
+	reg := &Registration{registry: registry, item: *item, stop: make(chan struct{})}
+	err := reg.send()
 	go func() {
-		t := time.NewTicker(duration)
-		for err == nil {
-			<-t.C
-			err = sendHeartbeat(registry, addr)
+		var backoff time.Duration
+		for {
+			delay := duration
+			if err != nil {
+				// retry sooner, the server expires if the registry misses heartbeats for a TTL
+				backoff = backoff*2 + 100*time.Millisecond
+				if backoff < delay {
+					delay = backoff
+				}
+			} else {
+				backoff = 0
+			}
+			t := time.NewTimer(delay)
+			select {
+			case <-reg.stop:
+				t.Stop()
+				return
+			case <-t.C:
+			}
+			err = reg.send()
 		}
 	}()
-}
-
-func sendHeartbeat(registry, addr string) error {
-	log.Println(addr, "send heart beat to registry", registry)
-	httpClient := &http.Client{}
-	req, _ := http.NewRequest("POST", registry, nil)
-	req.Header.Set("X-Geerpc-Server", addr)
-	if _, err := httpClient.Do(req); err != nil {
-		log.Println("rpc server: heart beat err:", err)
-		return err
-	}
-	return nil
+	return reg
 }
@@ -0,0 +1,147 @@
+package registry
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func TestGeeRegistry_Leases(t *testing.T) {
+	r := New(time.Minute)
+	defer func() { _ = r.Close() }()
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	countFoo := func() int {
+		list, err := List(ts.URL, "Foo")
+		_assert(err == nil, "failed to list: %v", err)
+		return len(list.Servers)
+	}
+
+	a := HeartbeatService(ts.URL, &ServerItem{Service: "Foo", Addr: "tcp@a", TTL: 150 * time.Millisecond}, 0)
+	lease := a.Lease()
+	_assert(lease != 0, "expect a lease")
+	time.Sleep(300 * time.Millisecond)
+	_assert(countFoo() == 1 && a.Lease() == lease, "expect heartbeats to keep the lease alive")
+	a.Stop()
+	time.Sleep(300 * time.Millisecond)
+	_assert(countFoo() == 0, "expect the reaper to remove the server once its TTL elapses")
+
+	b := HeartbeatService(ts.URL, &ServerItem{Service: "Foo", Addr: "tcp@b"}, time.Minute)
+	_assert(b.Lease() != lease && countFoo() == 1, "expect a new lease for another server")
+	_assert(b.Deregister() == nil && countFoo() == 0, "expect the server to be deregistered at once")
+
+	c := Heartbeat(ts.URL, "tcp@c", time.Minute)
+	defer c.Stop()
+	req, _ := http.NewRequest("DELETE", ts.URL, nil)
+	req.Header.Set("X-Geerpc-Server", "tcp@c")
+	resp, err := http.DefaultClient.Do(req)
+	_assert(err == nil && resp.StatusCode == http.StatusOK && countFoo() == 0, "expect the header API to deregister the server")
+	_ = resp.Body.Close()
+}
+
+func TestRegistration_Heartbeat(t *testing.T) {
+	r := New(time.Minute)
+	defer func() { _ = r.Close() }()
+	var failing, delay int64 = 1, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" {
+			if atomic.LoadInt64(&failing) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			time.Sleep(time.Duration(atomic.LoadInt64(&delay)))
+		}
+		r.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+	countFoo := func() int {
+		list, err := List(ts.URL, "Foo")
+		_assert(err == nil, "failed to list: %v", err)
+		return len(list.Servers)
+	}
+
+	a := HeartbeatService(ts.URL, &ServerItem{Service: "Foo", Addr: "tcp@a"}, time.Minute)
+	_assert(a.Lease() == 0, "expect the first heartbeat to fail")
+	atomic.StoreInt64(&failing, 0)
+	time.Sleep(300 * time.Millisecond)
+	_assert(a.Lease() != 0 && countFoo() == 1, "expect heartbeats to be retried until they succeed")
+	_assert(a.Deregister() == nil && countFoo() == 0, "failed to deregister")
+
+	b := HeartbeatService(ts.URL, &ServerItem{Service: "Foo", Addr: "tcp@b"}, 20*time.Millisecond)
+	atomic.StoreInt64(&delay, int64(200*time.Millisecond))
+	time.Sleep(50 * time.Millisecond) // a heartbeat is in flight
+	start := time.Now()
+	_ = b.Deregister()
+	_assert(time.Since(start) < 100*time.Millisecond, "expect Deregister not to wait for the heartbeat in flight")
+	time.Sleep(300 * time.Millisecond)
+	_assert(countFoo() == 0, "expect the heartbeat in flight not to register the server again")
+}
+
+// deadURL returns the URL of a registry nobody listens on
+func deadURL() string {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	_ = l.Close()
+	return "http://" + l.Addr().String()
+}
+
+func TestGeeRegistry_Cluster(t *testing.T) {
+	r1, r2 := New(time.Minute), New(time.Minute)
+	defer func() { _ = r1.Close() }()
+	defer func() { _ = r2.Close() }()
+	ts1, ts2 := httptest.NewServer(r1), httptest.NewServer(r2)
+	defer ts1.Close()
+	defer ts2.Close()
+	r1.SetPeers(ts2.URL)
+	r2.SetPeers(ts1.URL)
+	// eventually polls the registry at u until it lists expect for Foo
+	eventually := func(u, expect string) {
+		for i := 0; i < 50; i++ {
+			list, err := List(u, "Foo")
+			if err == nil {
+				var addrs []string
+				for _, item := range list.Servers {
+					addrs = append(addrs, item.Addr)
+				}
+				if strings.Join(addrs, ",") == expect {
+					return
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		_assert(false, "expect %s to list %q", u, expect)
+	}
+
+	a := HeartbeatService(ts1.URL, &ServerItem{Service: "Foo", Addr: "tcp@a"}, time.Minute)
+	defer a.Stop()
+	eventually(ts2.URL, "tcp@a")
+	list, _ := List(ts2.URL, "Foo")
+	_assert(list.Servers[0].Lease == a.Lease(), "expect the lease to be replicated")
+	b := Heartbeat(ts2.URL, "tcp@b", time.Minute)
+	defer b.Stop()
+	eventually(ts1.URL, "tcp@a,tcp@b")
+
+	// a new member starts with the registrations of its peers
+	r3 := New(time.Minute)
+	defer func() { _ = r3.Close() }()
+	ts3 := httptest.NewServer(r3)
+	defer ts3.Close()
+	r3.SetPeers(ts1.URL)
+	eventually(ts3.URL, "tcp@a,tcp@b")
+
+	_assert(a.Deregister() == nil, "failed to deregister")
+	eventually(ts2.URL, "tcp@b")
+	_, err := Register(deadURL()+","+ts2.URL, &ServerItem{Service: "Foo", Addr: "tcp@c"})
+	_assert(err == nil, "expect registering to fail over: %v", err)
+	eventually(ts1.URL, "tcp@b,tcp@c")
+}
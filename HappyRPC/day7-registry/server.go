@@ -5,6 +5,9 @@
 package geerpc
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,8 +17,10 @@ import (
 	"net"
 	"net/http"
 	"reflect"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,6 +31,13 @@ type Option struct {
 	CodecType      codec.Type    // client may choose different Codec to encode body
 	ConnectTimeout time.Duration // 0 means no limit
 	HandleTimeout  time.Duration
+	Multiplex      bool              // split messages into frames interleaved across calls, see codec.FramedCodec
+	TLSConfig      *tls.Config       `json:"-"`          // used by DialTLS and DialHTTPS, nil means the default config
+	Credentials    Credentials       `json:"-"`          // authenticate the client to the server
+	AuthData       map[string]string `json:",omitempty"` // set by the client from Credentials
+	PingInterval   time.Duration     // client pings the server when nothing is received for it, 0 disables
+	PingTimeout    time.Duration     // client closes the connection if a ping isn't answered in time, 0 means PingInterval
+	Reconnect      *ReconnectPolicy  `json:"-"` // redial the server once the connection is broken, nil disables. Used by Dial and its variants
 }
 
 var DefaultOption = &Option{
@@ -36,7 +48,19 @@ var DefaultOption = &Option{
 
 // Server represents an RPC Server.
 type Server struct {
-	serviceMap sync.Map
+	handling      int64 // number of requests being handled, accessed atomically
+	serviceMap    sync.Map
+	interceptors  []UnaryServerInterceptor
+	authenticator Authenticator
+	acl           ACL
+	panicStack    bool // send the stack of a panicking method back with the error
+	pingInterval  time.Duration
+	pingTimeout   time.Duration
+	mu            sync.Mutex // protect following
+	listeners     map[net.Listener]struct{}
+	conns         map[*serverConn]struct{}
+	onShutdown    []func()
+	inShutdown    bool
 }
 
 // NewServer returns a new Server.
@@ -47,50 +71,225 @@ func NewServer() *Server {
 // DefaultServer is the default instance of *Server.
 var DefaultServer = NewServer()
 
+// Handshake is the server's reply to Option, it advertises
+// the supported codecs and tells the client why the Option is rejected.
+type Handshake struct {
+	Codecs []codec.Type
+	Error  string
+	Code   Code `json:",omitempty"`
+}
+
 // ServeConn runs the server on a single connection.
 // ServeConn blocks, serving the connection until the client hangs up.
+// The client starts with its Option in JSON terminated by a newline,
+// as json.Encoder writes it, followed by the messages of its codec.
 func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 	defer func() { _ = conn.Close() }()
 	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&opt); err != nil {
 		log.Println("rpc server: options error: ", err)
 		return
 	}
-	if opt.MagicNumber != MagicNumber {
-		log.Printf("rpc server: invalid magic number %x", opt.MagicNumber)
+	f, err := checkOption(&opt)
+	if err == nil && server.shuttingDown() {
+		err = ErrServerClosed
+	}
+	peer := newPeer(conn)
+	if err == nil {
+		err = server.authenticate(peer, opt.AuthData)
+	}
+	hs := Handshake{Codecs: codec.Types()}
+	if err != nil {
+		hs.Error, hs.Code = err.Error(), StatusOf(err).Code
+	}
+	if err := writeHandshake(conn, &hs); err != nil {
+		log.Println("rpc server: handshake error: ", err)
 		return
 	}
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f == nil {
-		log.Printf("rpc server: invalid codec type %s", opt.CodecType)
+	if err != nil {
+		log.Println("rpc server:", err)
+		return
+	}
+	// the json decoder may read ahead of the option, so hand what it buffered to the codec
+	r := &optionEnd{r: bufio.NewReader(io.MultiReader(dec.Buffered(), conn))}
+	sc := &serverConn{cc: newCodec(f, &bufferedConn{conn, r}, &opt), sending: new(sync.Mutex), peer: peer}
+	if !server.trackConn(sc, true) {
 		return
 	}
-	server.serveCodec(f(conn), &opt)
+	defer server.trackConn(sc, false)
+	server.serveCodec(sc, &opt)
+}
+
+func checkOption(opt *Option) (codec.NewCodecFunc, error) {
+	if opt.MagicNumber != MagicNumber {
+		return nil, fmt.Errorf("invalid magic number %x", opt.MagicNumber)
+	}
+	f, ok := codec.Lookup(opt.CodecType)
+	if !ok {
+		return nil, fmt.Errorf("invalid codec type %s", opt.CodecType)
+	}
+	return f, nil
+}
+
+// newCodec builds the codec of a connection, framed if opt asks for multiplexing
+func newCodec(f codec.NewCodecFunc, conn io.ReadWriteCloser, opt *Option) codec.Codec {
+	if opt.Multiplex {
+		return codec.NewFramedCodec(conn, f)
+	}
+	return f(conn)
+}
+
+// writeHandshake writes hs without a trailing newline,
+// so nothing is left on the connection for the client's codec.
+func writeHandshake(conn io.Writer, hs *Handshake) error {
+	data, err := json.Marshal(hs)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+// bufferedConn reads from r instead of the underlying connection
+type bufferedConn struct {
+	io.ReadWriteCloser
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+var errOptionEnd = errors.New("rpc server: option must be terminated by a newline")
+
+// optionEnd consumes the newline terminating the Option before the first read of the codec
+type optionEnd struct {
+	r       *bufio.Reader
+	checked bool
+}
+
+func (o *optionEnd) Read(p []byte) (int, error) {
+	if !o.checked {
+		b, err := o.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != '\n' {
+			return 0, errOptionEnd
+		}
+		o.checked = true
+	}
+	return o.r.Read(p)
 }
 
 // invalidRequest is a placeholder for response argv when error occurs
 var invalidRequest = struct{}{}
 
-func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
-	sending := new(sync.Mutex) // make sure to send a complete response
-	wg := new(sync.WaitGroup)  // wait until all request are handled
+func (server *Server) serveCodec(sc *serverConn, opt *Option) {
+	cc, sending := sc.cc, sc.sending
+	wg := new(sync.WaitGroup) // wait until all request are handled
+	handling := new(sync.Map) // seq -> context.CancelFunc of requests being handled
+	streams := new(sync.Map)  // seq -> *serverStream of streams being handled
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), peerKey{}, sc.peer))
+	alive := new(liveness)
+	alive.touch()
+	if server.pingInterval > 0 {
+		ping := func() error {
+			sending.Lock()
+			defer sending.Unlock()
+			return cc.Write(&codec.Header{Ping: true}, invalidRequest)
+		}
+		dead := func() {
+			log.Println("rpc server: client didn't answer ping, closing connection")
+			_ = cc.Close()
+		}
+		go keepalive(alive, server.pingInterval, server.pingTimeout, ping, dead, ctx.Done())
+	}
 	for {
-		req, err := server.readRequest(cc)
+		req, err := server.readRequest(cc, streams)
+		if req != nil {
+			alive.touch()
+		}
 		if err != nil {
 			if req == nil {
 				break // it's not possible to recover, so close the connection
 			}
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sending)
+			server.sendError(cc, req.h, err, sending)
 			continue
 		}
+		if req.h.Ping {
+			server.sendResponse(cc, &codec.Header{Pong: true}, invalidRequest, sending)
+			continue
+		}
+		if req.h.Pong {
+			continue // only proves the client is alive, it has been touched above
+		}
+		if req.h.Cancel {
+			if f, ok := handling.Load(req.h.Seq); ok {
+				f.(context.CancelFunc)()
+			}
+			continue
+		}
+		if req.svc == nil {
+			continue // frame of a stream, it has been delivered by readRequest
+		}
+		if req.mtype.stream != req.h.Stream {
+			server.sendError(cc, req.h, Errorf(CodeInvalidArgument, "rpc server: %s can't be called as a %s", req.h.ServiceMethod, callKind(req.h.Stream)), sending)
+			continue
+		}
+		if err := server.authorize(sc.peer, req.h.ServiceMethod); err != nil {
+			server.sendError(cc, req.h, err, sending)
+			continue
+		}
+		if req.h.Timeout < 0 {
+			// the caller's deadline passed before the request was sent
+			server.sendError(cc, req.h, Errorf(CodeDeadlineExceeded, "rpc server: request handle timeout: caller's deadline exceeded"), sending)
+			continue
+		}
+		timeout := handleTimeout(opt.HandleTimeout, req.h.Timeout)
+		reqCtx, reqCancel := context.WithCancel(ctx)
+		if timeout > 0 {
+			reqCtx, reqCancel = context.WithTimeout(ctx, timeout)
+		}
+		handling.Store(req.h.Seq, reqCancel)
+		var ss *serverStream
+		if req.mtype.stream {
+			// register the stream before reading its following frames
+			ss = newServerStream(reqCtx, sc, req)
+			streams.Store(req.h.Seq, ss)
+		}
 		wg.Add(1)
-		go server.handleRequest(cc, req, sending, wg, opt.HandleTimeout)
+		atomic.AddInt64(&server.handling, 1)
+		go func(req *request) {
+			defer wg.Done()
+			defer atomic.AddInt64(&server.handling, -1)
+			if ss != nil {
+				server.handleStream(ss, req, timeout)
+				streams.Delete(req.h.Seq)
+			} else {
+				server.handleRequest(reqCtx, cc, req, sending, timeout)
+			}
+			handling.Delete(req.h.Seq)
+			reqCancel()
+		}(req)
 	}
+	cancel() // the client has hung up, stop the requests still being handled
 	wg.Wait()
 	_ = cc.Close()
 }
 
+// handleTimeout returns the smaller one of the server's HandleTimeout
+// and the caller's remaining time, 0 means no limit.
+// A negative remaining time means the caller's deadline has passed,
+// such requests are rejected before handleTimeout.
+func handleTimeout(server, caller time.Duration) time.Duration {
+	if server == 0 || (caller > 0 && caller < server) {
+		return caller
+	}
+	return server
+}
+
 // request stores all information of a call
 type request struct {
 	h            *codec.Header // header of request
@@ -113,35 +312,60 @@ func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 func (server *Server) findService(serviceMethod string) (svc *service, mtype *methodType, err error) {
 	dot := strings.LastIndex(serviceMethod, ".")
 	if dot < 0 {
-		err = errors.New("rpc server: service/method request ill-formed: " + serviceMethod)
+		err = Errorf(CodeMethodNotFound, "rpc server: service/method request ill-formed: %s", serviceMethod)
 		return
 	}
 	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
 	svci, ok := server.serviceMap.Load(serviceName)
 	if !ok {
-		err = errors.New("rpc server: can't find service " + serviceName)
+		err = Errorf(CodeMethodNotFound, "rpc server: can't find service %s", serviceName)
 		return
 	}
 	svc = svci.(*service)
 	mtype = svc.method[methodName]
 	if mtype == nil {
-		err = errors.New("rpc server: can't find method " + methodName)
+		err = Errorf(CodeMethodNotFound, "rpc server: can't find method %s", methodName)
 	}
 	return
 }
 
-func (server *Server) readRequest(cc codec.Codec) (*request, error) {
+func (server *Server) readRequest(cc codec.Codec, streams *sync.Map) (*request, error) {
 	h, err := server.readRequestHeader(cc)
 	if err != nil {
 		return nil, err
 	}
 	req := &request{h: h}
+	if h.Cancel || h.Ping || h.Pong {
+		// cancel and ping frames carry an empty body
+		if err = cc.ReadBody(nil); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
+	if h.Stream && h.ServiceMethod == "" {
+		// a following frame of an open stream
+		if ss, ok := streams.Load(h.Seq); ok {
+			err = ss.(*serverStream).readFrame(cc, h)
+		} else {
+			err = cc.ReadBody(nil) // the stream has ended, drop the frame
+		}
+		if err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
 	req.svc, req.mtype, err = server.findService(h.ServiceMethod)
 	if err != nil {
+		// drop the body so that the following requests can still be read
+		if bodyErr := cc.ReadBody(nil); bodyErr != nil {
+			return nil, bodyErr
+		}
 		return req, err
 	}
 	req.argv = req.mtype.newArgv()
-	req.replyv = req.mtype.newReplyv()
+	if !req.mtype.stream {
+		req.replyv = req.mtype.newReplyv()
+	}
 
 	// make sure that argvi is a pointer, ReadBody need a pointer as parameter
 	argvi := req.argv.Interface()
@@ -150,12 +374,38 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	}
 	if err = cc.ReadBody(argvi); err != nil {
 		log.Println("rpc server: read body err:", err)
-		return req, err
+		return req, Errorf(CodeInvalidArgument, "rpc server: read body err: %v", err)
 	}
 	return req, nil
 }
 
+// sendError sends err as the response of h, it also ends the stream of h
+func (server *Server) sendError(cc codec.Codec, h *codec.Header, err error, sending *sync.Mutex) {
+	setError(h, err)
+	h.Metadata = nil
+	h.EOS = h.Stream
+	server.sendResponse(cc, h, invalidRequest, sending)
+}
+
+func callKind(stream bool) string {
+	if stream {
+		return "stream"
+	}
+	return "unary call"
+}
+
+// waitWritable waits until cc can queue a message of seq, before the caller
+// takes the lock shared by all seqs of the connection, so that a stream
+// sending faster than the connection doesn't hold up the others.
+// An error is left to the following Write.
+func waitWritable(cc codec.Codec, seq uint64) {
+	if t, ok := cc.(codec.Throttler); ok {
+		_ = t.WaitWritable(seq)
+	}
+}
+
 func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interface{}, sending *sync.Mutex) {
+	waitWritable(cc, h.Seq)
 	sending.Lock()
 	defer sending.Unlock()
 	if err := cc.Write(h, body); err != nil {
@@ -163,44 +413,119 @@ func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interfa
 	}
 }
 
-func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
-	defer wg.Done()
-	called := make(chan struct{})
-	sent := make(chan struct{})
+func (server *Server) handleRequest(ctx context.Context, cc codec.Codec, req *request, sending *sync.Mutex, timeout time.Duration) {
+	ctx, md := newServerContext(ctx, req.h.Metadata)
+	req.h.Metadata = nil // don't echo the request metadata back
+	called := make(chan error, 1)
 	go func() {
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
-		called <- struct{}{}
+		// a panicking method must not take down the other requests and connections
+		defer func() {
+			if p := recover(); p != nil {
+				called <- server.panicError(req, p)
+			}
+		}()
+		called <- server.invoke(ctx, req)
+	}()
+
+	select {
+	case <-ctx.Done():
+		if ctx.Err() == context.Canceled {
+			return // the caller has given up, nobody waits for the response
+		}
+		setError(req.h, Errorf(CodeDeadlineExceeded, "rpc server: request handle timeout: expect within %s", timeout))
+		server.sendResponse(cc, req.h, invalidRequest, sending)
+	case err := <-called:
+		req.h.Metadata = md.get()
 		if err != nil {
-			req.h.Error = err.Error()
+			setError(req.h, err)
 			server.sendResponse(cc, req.h, invalidRequest, sending)
-			sent <- struct{}{}
 			return
 		}
 		server.sendResponse(cc, req.h, req.replyv.Interface(), sending)
-		sent <- struct{}{}
+	}
+}
+
+func (server *Server) handleStream(ss *serverStream, req *request, timeout time.Duration) {
+	ctx := ss.ctx
+	called := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				called <- server.panicError(req, p)
+			}
+		}()
+		called <- req.svc.callStream(req.mtype, req.argv, ss)
 	}()
 
-	if timeout == 0 {
-		<-called
-		<-sent
-		return
-	}
+	h := &codec.Header{Seq: req.h.Seq, Stream: true, EOS: true}
 	select {
-	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-		server.sendResponse(cc, req.h, invalidRequest, sending)
-	case <-called:
-		<-sent
+	case <-ctx.Done():
+		if ctx.Err() == context.Canceled {
+			return
+		}
+		setError(h, Errorf(CodeDeadlineExceeded, "rpc server: request handle timeout: expect within %s", timeout))
+	case err := <-called:
+		h.Metadata = ss.md.get()
+		if err != nil {
+			setError(h, err)
+		}
 	}
+	ss.closeSend(io.EOF)
+	_ = ss.write(h, invalidRequest)
+}
+
+// panicError counts the panic of req and converts it into an error
+func (server *Server) panicError(req *request, p interface{}) error {
+	atomic.AddUint64(&req.mtype.numPanics, 1)
+	const size = 64 << 10
+	stack := make([]byte, size)
+	stack = stack[:runtime.Stack(stack, false)]
+	log.Printf("rpc server: panic in %s: %v\n%s", req.h.ServiceMethod, p, stack)
+	if server.panicStack {
+		return Errorf(CodeInternal, "rpc server: panic in %s: %v\n%s", req.h.ServiceMethod, p, stack)
+	}
+	return Errorf(CodeInternal, "rpc server: panic in %s: %v", req.h.ServiceMethod, p)
+}
+
+// invoke calls the service method of req through the interceptors
+func (server *Server) invoke(ctx context.Context, req *request) error {
+	handler := func(ctx context.Context, _, _ interface{}) error {
+		return req.svc.call(ctx, req.mtype, req.argv, req.replyv)
+	}
+	if len(server.interceptors) == 0 {
+		return handler(ctx, nil, nil)
+	}
+	h := chainUnaryServer(server.interceptors, req.h.ServiceMethod, handler)
+	return h(ctx, req.argv.Interface(), req.replyv.Interface())
+}
+
+// Use appends interceptors wrapping every request handled by the server,
+// the first one is the outermost. It should be called before serving.
+func (server *Server) Use(interceptors ...UnaryServerInterceptor) {
+	server.interceptors = append(server.interceptors, interceptors...)
+}
+
+// SetPanicStack makes the server send the stack of a panicking method back
+// to the client along with the error, e.g. for debugging. The stack is
+// always logged. It should be called before serving.
+func (server *Server) SetPanicStack(enabled bool) {
+	server.panicStack = enabled
 }
 
 // Accept accepts connections on the listener and serves requests
 // for each incoming connection.
 func (server *Server) Accept(lis net.Listener) {
+	if !server.trackListener(lis, true) {
+		_ = lis.Close()
+		return
+	}
+	defer server.trackListener(lis, false)
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Println("rpc server: accept error:", err)
+			if !server.shuttingDown() {
+				log.Println("rpc server: accept error:", err)
+			}
 			return
 		}
 		go server.ServeConn(conn)
@@ -213,10 +538,18 @@ func Accept(lis net.Listener) { DefaultServer.Accept(lis) }
 
 // Register publishes in the server the set of methods of the
 // receiver value that satisfy the following conditions:
-//	- exported method of exported type
-//	- two arguments, both of exported type
-//	- the second argument is a pointer
-//	- one return value, of type error
+//   - exported method of exported type
+//   - two arguments, both of exported type
+//   - the second argument is a pointer, or a ServerStream for a streaming method
+//   - one return value, of type error
+//   - optionally a context.Context before the two arguments
+//
+// A streaming method has the form
+//
+//	func (t *T) Method(args *Args, stream geerpc.ServerStream) error
+//
+// it's called by Client.NewStream, see ServerStream. It takes no context.Context,
+// stream.Context() carries it.
 func (server *Server) Register(rcvr interface{}) error {
 	s := newService(rcvr)
 	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
@@ -1,23 +1,37 @@
 package geerpc
 
 import (
+	"context"
 	"go/ast"
 	"log"
 	"reflect"
 	"sync/atomic"
 )
 
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfStream  = reflect.TypeOf((*ServerStream)(nil)).Elem()
+)
+
 type methodType struct {
 	method    reflect.Method
 	ArgType   reflect.Type
 	ReplyType reflect.Type
+	withCtx   bool // method takes a context.Context as the first argument
+	stream    bool // method takes a ServerStream instead of reply
 	numCalls  uint64
+	numPanics uint64
 }
 
 func (m *methodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+func (m *methodType) NumPanics() uint64 {
+	return atomic.LoadUint64(&m.numPanics)
+}
+
 func (m *methodType) newArgv() reflect.Value {
 	var argv reflect.Value
 	// arg may be a pointer type, or a value type
@@ -29,6 +43,14 @@ func (m *methodType) newArgv() reflect.Value {
 	return argv
 }
 
+// elemType returns the type of the messages a streaming method receives
+func (m *methodType) elemType() reflect.Type {
+	if m.ArgType.Kind() == reflect.Ptr {
+		return m.ArgType.Elem()
+	}
+	return m.ArgType
+}
+
 func (m *methodType) newReplyv() reflect.Value {
 	// reply must be a pointer type
 	replyv := reflect.New(m.ReplyType.Elem())
@@ -65,29 +87,53 @@ func (s *service) registerMethods() {
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
 		mType := method.Type
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		if mType.NumOut() != 1 || mType.Out(0) != typeOfError {
 			continue
 		}
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		// func(args, reply) error or func(ctx, args, reply) error, receiver included
+		withCtx := mType.NumIn() == 4 && mType.In(1) == typeOfContext
+		if mType.NumIn() != 3 && !withCtx {
 			continue
 		}
-		argType, replyType := mType.In(1), mType.In(2)
+		argType, replyType := mType.In(mType.NumIn()-2), mType.In(mType.NumIn()-1)
 		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
 			continue
 		}
+		// func(args, stream) error, the context comes with stream
+		stream := replyType == typeOfStream
+		if stream && withCtx {
+			continue
+		}
 		s.method[method.Name] = &methodType{
 			method:    method,
 			ArgType:   argType,
 			ReplyType: replyType,
+			withCtx:   withCtx,
+			stream:    stream,
 		}
 		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
 }
 
-func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+func (s *service) call(ctx context.Context, m *methodType, argv, replyv reflect.Value) error {
+	atomic.AddUint64(&m.numCalls, 1)
+	f := m.method.Func
+	in := []reflect.Value{s.rcvr, argv, replyv}
+	if m.withCtx {
+		in = []reflect.Value{s.rcvr, reflect.ValueOf(ctx), argv, replyv}
+	}
+	returnValues := f.Call(in)
+	if errInter := returnValues[0].Interface(); errInter != nil {
+		return errInter.(error)
+	}
+	return nil
+}
+
+// callStream invokes a streaming method with args as the first message
+func (s *service) callStream(m *methodType, argv reflect.Value, stream ServerStream) error {
 	atomic.AddUint64(&m.numCalls, 1)
 	f := m.method.Func
-	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	returnValues := f.Call([]reflect.Value{s.rcvr, argv, reflect.ValueOf(&stream).Elem()})
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
@@ -0,0 +1,139 @@
+package geerpc
+
+import (
+	"context"
+	"geerpc/codec"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is reported to clients connecting to a server in Shutdown
+var ErrServerClosed = &Status{Code: CodeUnavailable, Message: "rpc server: server closed"}
+
+// shutdownPollInterval is how often Shutdown checks
+// whether all requests have been handled.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// serverConn is a connection being served
+type serverConn struct {
+	cc      codec.Codec
+	sending *sync.Mutex // make sure to send a complete response
+	peer    *Peer
+}
+
+// goAway tells the client not to send new calls on this connection
+func (sc *serverConn) goAway() {
+	sc.sending.Lock()
+	defer sc.sending.Unlock()
+	_ = sc.cc.Write(&codec.Header{GoAway: true}, invalidRequest)
+}
+
+func (server *Server) shuttingDown() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.inShutdown
+}
+
+// trackListener adds or removes lis, it returns false if the server is shutting down.
+func (server *Server) trackListener(lis net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.listeners == nil {
+		server.listeners = make(map[net.Listener]struct{})
+	}
+	if !add {
+		delete(server.listeners, lis)
+		return true
+	}
+	if server.inShutdown {
+		return false
+	}
+	server.listeners[lis] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes sc, it returns false if the server is shutting down.
+func (server *Server) trackConn(sc *serverConn, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.conns == nil {
+		server.conns = make(map[*serverConn]struct{})
+	}
+	if !add {
+		delete(server.conns, sc)
+		return true
+	}
+	if server.inShutdown {
+		return false
+	}
+	server.conns[sc] = struct{}{}
+	return true
+}
+
+// RegisterOnShutdown registers a function to call at the start of Shutdown,
+// e.g. to deregister the server from the registry.
+func (server *Server) RegisterOnShutdown(f func()) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.onShutdown = append(server.onShutdown, f)
+}
+
+// Shutdown gracefully shuts down the server. It runs the functions registered
+// by RegisterOnShutdown, closes all listeners, tells the clients to stop sending
+// new calls and waits for the requests being handled, then closes all connections.
+// If ctx is done before all requests are handled, the connections are closed
+// anyway, the requests still being handled are canceled and ctx's error is returned.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	server.inShutdown = true
+	hooks := server.onShutdown
+	for lis := range server.listeners {
+		_ = lis.Close()
+	}
+	conns := make([]*serverConn, 0, len(server.conns))
+	for sc := range server.conns {
+		conns = append(conns, sc)
+	}
+	server.mu.Unlock()
+
+	for _, f := range hooks {
+		f()
+	}
+	for _, sc := range conns {
+		sc.goAway()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	var err error
+	for atomic.LoadInt64(&server.handling) > 0 && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	server.closeConns()
+	return err
+}
+
+// closeConns closes all connections at once, each may wait for its queued responses to be sent
+func (server *Server) closeConns() {
+	server.mu.Lock()
+	conns := make([]*serverConn, 0, len(server.conns))
+	for sc := range server.conns {
+		conns = append(conns, sc)
+	}
+	server.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, sc := range conns {
+		wg.Add(1)
+		go func(sc *serverConn) {
+			defer wg.Done()
+			_ = sc.cc.Close()
+		}(sc)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,268 @@
+package geerpc
+
+import (
+	"context"
+	"errors"
+	"geerpc/codec"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// streamWindow is the number of messages a peer may send on a stream
+// before the receiver grants more credit.
+const streamWindow = 64
+
+// ServerStream is passed to streaming service methods of the form
+//
+//	func (t *T) Method(args *Args, stream geerpc.ServerStream) error
+//
+// args is the first message sent by the client, and Recv decodes the
+// following ones, which must be of the same type as args.
+// Returning from the method ends the stream.
+type ServerStream interface {
+	// Context returns the context of the stream, it carries the metadata
+	// sent by the client and is done when the client gives up.
+	Context() context.Context
+	// Send sends m to the client, it blocks until the client has room for m.
+	Send(m interface{}) error
+	// Recv receives the next message into m, it returns io.EOF once
+	// the client has called CloseSend.
+	Recv(m interface{}) error
+}
+
+// stream is the state shared by both ends of a streaming call.
+// Messages are queued by the receiving loop of the connection, so a slow
+// consumer only blocks its own stream, and the sender is flow controlled
+// by credits granted by the receiver.
+type stream struct {
+	seq      uint64
+	ctx      context.Context
+	elemType reflect.Type // type of the messages received
+	write    func(h *codec.Header, body interface{}) error
+
+	mu        sync.Mutex // protect following
+	queue     []reflect.Value
+	recvErr   error // io.EOF or the error that ended receiving
+	sendErr   error // the error that ended sending
+	credit    int   // number of messages that can still be sent
+	consumed  int   // number of messages received since credit was granted
+	recvReady chan struct{}
+	sendReady chan struct{}
+}
+
+func newStream(ctx context.Context, seq uint64, elemType reflect.Type, write func(*codec.Header, interface{}) error) *stream {
+	return &stream{
+		seq:       seq,
+		ctx:       ctx,
+		elemType:  elemType,
+		write:     write,
+		credit:    streamWindow,
+		recvReady: make(chan struct{}, 1),
+		sendReady: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (s *stream) Context() context.Context {
+	return s.ctx
+}
+
+// readFrame reads the body of a stream frame from cc and updates the stream
+func (s *stream) readFrame(cc codec.Codec, h *codec.Header) error {
+	switch {
+	case h.Credit > 0:
+		s.mu.Lock()
+		s.credit += int(h.Credit)
+		s.mu.Unlock()
+		notify(s.sendReady)
+		return cc.ReadBody(nil)
+	case h.EOS:
+		var err error = io.EOF
+		if h.Error != "" {
+			err = newCallError(h)
+		}
+		s.closeRecv(err)
+		return cc.ReadBody(nil)
+	}
+	v := reflect.New(s.elemType)
+	if err := cc.ReadBody(v.Interface()); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.queue = append(s.queue, v)
+	s.mu.Unlock()
+	notify(s.recvReady)
+	return nil
+}
+
+// closeRecv ends receiving with err, messages already queued can still be received
+func (s *stream) closeRecv(err error) {
+	s.mu.Lock()
+	if s.recvErr == nil {
+		s.recvErr = err
+	}
+	s.mu.Unlock()
+	notify(s.recvReady)
+}
+
+// closeSend makes the following Send fail with err
+func (s *stream) closeSend(err error) {
+	s.mu.Lock()
+	if s.sendErr == nil {
+		s.sendErr = err
+	}
+	s.mu.Unlock()
+	notify(s.sendReady)
+}
+
+func (s *stream) Recv(m interface{}) error {
+	mv := reflect.ValueOf(m)
+	if mv.Kind() != reflect.Ptr || mv.Type().Elem() != s.elemType {
+		return errors.New("rpc stream: Recv expects a " + reflect.PtrTo(s.elemType).String())
+	}
+	for {
+		s.mu.Lock()
+		if len(s.queue) > 0 {
+			v := s.queue[0]
+			s.queue = s.queue[1:]
+			s.consumed++
+			credit := 0
+			if s.consumed >= streamWindow/2 && s.recvErr == nil {
+				credit, s.consumed = s.consumed, 0
+			}
+			s.mu.Unlock()
+			mv.Elem().Set(v.Elem())
+			if credit > 0 {
+				_ = s.write(&codec.Header{Seq: s.seq, Stream: true, Credit: uint32(credit)}, invalidRequest)
+			}
+			return nil
+		}
+		err := s.recvErr
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		select {
+		case <-s.recvReady:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+func (s *stream) Send(m interface{}) error {
+	for {
+		s.mu.Lock()
+		if s.sendErr != nil {
+			err := s.sendErr
+			s.mu.Unlock()
+			return err
+		}
+		if s.credit > 0 {
+			s.credit--
+			s.mu.Unlock()
+			return s.write(&codec.Header{Seq: s.seq, Stream: true}, m)
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.sendReady:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+// ClientStream is a streaming call started by Client.NewStream
+type ClientStream struct {
+	*stream
+	client *Client
+	done   chan struct{} // closed when the stream is finished
+	once   sync.Once
+}
+
+// NewStream starts a streaming call of serviceMethod and sends args as the
+// first message. Messages sent by the server are received into values of
+// the same type as reply, which must be a pointer.
+// The stream is canceled once ctx is done.
+func (client *Client) NewStream(ctx context.Context, serviceMethod string, args, reply interface{}) (*ClientStream, error) {
+	rt := reflect.TypeOf(reply)
+	if rt == nil || rt.Kind() != reflect.Ptr {
+		return nil, errors.New("rpc client: reply of a stream must be a pointer")
+	}
+	cs := &ClientStream{client: client, done: make(chan struct{})}
+	client.mu.Lock()
+	if client.closing || client.shutdown || client.draining || client.reconnecting {
+		client.mu.Unlock()
+		return nil, ErrShutdown
+	}
+	seq := client.seq
+	client.seq++
+	cs.stream = newStream(ctx, seq, rt.Elem(), client.writeFrame)
+	client.streams[seq] = cs
+	client.mu.Unlock()
+
+	h := &codec.Header{ServiceMethod: serviceMethod, Seq: seq, Stream: true, Metadata: FromOutgoingContext(ctx)}
+	if deadline, ok := ctx.Deadline(); ok {
+		h.Timeout = time.Until(deadline)
+	}
+	if err := client.writeFrame(h, args); err != nil {
+		cs.finish(err)
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			// tell the server to stop the handler
+			_ = client.writeFrame(&codec.Header{Seq: seq, Cancel: true}, invalidRequest)
+			cs.finish(ctx.Err())
+		case <-cs.done:
+		}
+	}()
+	return cs, nil
+}
+
+// CloseSend tells the server that no more messages will be sent,
+// messages can still be received until Recv returns io.EOF.
+func (cs *ClientStream) CloseSend() error {
+	cs.closeSend(errors.New("rpc stream: send on closed stream"))
+	return cs.write(&codec.Header{Seq: cs.seq, Stream: true, EOS: true}, invalidRequest)
+}
+
+// finish ends the stream with err and removes it from the client
+func (cs *ClientStream) finish(err error) {
+	cs.once.Do(func() {
+		cs.client.mu.Lock()
+		delete(cs.client.streams, cs.seq)
+		cs.client.mu.Unlock()
+		cs.closeRecv(err)
+		cs.closeSend(err)
+		close(cs.done)
+	})
+}
+
+// serverStream is the server end of a streaming call
+type serverStream struct {
+	*stream
+	md *responseMetadata
+}
+
+func newServerStream(ctx context.Context, sc *serverConn, req *request) *serverStream {
+	ctx, md := newServerContext(ctx, req.h.Metadata)
+	write := func(h *codec.Header, body interface{}) error {
+		waitWritable(sc.cc, h.Seq)
+		sc.sending.Lock()
+		defer sc.sending.Unlock()
+		return sc.cc.Write(h, body)
+	}
+	return &serverStream{newStream(ctx, req.h.Seq, req.mtype.elemType(), write), md}
+}
+
+var _ ServerStream = (*serverStream)(nil)
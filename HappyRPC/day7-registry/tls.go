@@ -0,0 +1,99 @@
+package geerpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"geerpc/codec"
+	"io"
+	"net"
+)
+
+// Peer describes the client of a request
+type Peer struct {
+	Addr net.Addr             // nil if the connection isn't a net.Conn
+	TLS  *tls.ConnectionState // nil if the connection isn't over TLS
+	// Principal is the identity returned by the server's Authenticator
+	Principal string
+}
+
+// Identity returns the verified certificate of a mutual TLS client, or nil
+func (p *Peer) Identity() *x509.Certificate {
+	if p == nil || p.TLS == nil || len(p.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return p.TLS.VerifiedChains[0][0]
+}
+
+type peerKey struct{}
+
+// PeerFromContext returns the client of the request,
+// it's only available in the context passed to a service method.
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(*Peer)
+	return p, ok
+}
+
+func newPeer(conn io.ReadWriteCloser) *Peer {
+	p := new(Peer)
+	if c, ok := conn.(net.Conn); ok {
+		p.Addr = c.RemoteAddr()
+	}
+	if c, ok := conn.(*tls.Conn); ok {
+		state := c.ConnectionState()
+		p.TLS = &state
+	}
+	return p
+}
+
+// AcceptTLS accepts connections on the listener, performs the TLS handshake
+// with config and serves requests for each incoming connection.
+// Set config.ClientAuth to tls.RequireAndVerifyClientCert for mutual TLS.
+func (server *Server) AcceptTLS(lis net.Listener, config *tls.Config) {
+	server.Accept(tls.NewListener(lis, config))
+}
+
+// AcceptTLS accepts TLS connections on the listener for default server
+func AcceptTLS(lis net.Listener, config *tls.Config) { DefaultServer.AcceptTLS(lis, config) }
+
+// ServeTLS is like AcceptTLS with the certificate and key loaded from files
+func (server *Server) ServeTLS(lis net.Listener, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	server.AcceptTLS(lis, &tls.Config{Certificates: []tls.Certificate{cert}})
+	return nil
+}
+
+// tlsHandshake wraps f to run it over a TLS connection configured by opt.TLSConfig
+func tlsHandshake(f handshakeFunc, address string) handshakeFunc {
+	return func(conn net.Conn, opt *Option) (codec.Codec, error) {
+		config := opt.TLSConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" && !config.InsecureSkipVerify {
+			config = config.Clone()
+			config.ServerName = address
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				config.ServerName = host
+			}
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		return f(tlsConn, opt)
+	}
+}
+
+// DialTLS connects to an RPC server over TLS at the specified network address
+func DialTLS(network, address string, opts ...*Option) (*Client, error) {
+	return dialTimeout(tlsHandshake(handshake, address), network, address, opts...)
+}
+
+// DialHTTPS connects to an HTTP RPC server over TLS at the specified network address
+func DialHTTPS(network, address string, opts ...*Option) (*Client, error) {
+	return dialTimeout(tlsHandshake(httpHandshake, address), network, address, opts...)
+}
@@ -0,0 +1,271 @@
+package xclient
+
+import (
+	"errors"
+	"fmt"
+	. "geerpc"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrBreakerOpen is returned for calls to a server whose circuit breaker is open
+var ErrBreakerOpen = errors.New("rpc xclient: circuit breaker is open")
+
+// BreakerState is the state of the circuit breaker of a server
+type BreakerState int
+
+const (
+	StateClosed   BreakerState = iota // calls go through
+	StateOpen                         // calls are rejected until OpenTimeout elapses
+	StateHalfOpen                     // a single probe call decides whether to close or open again
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+// BreakerConfig configures the circuit breakers of XClient
+type BreakerConfig struct {
+	ConsecutiveFailures int           // open after this many failures in a row, 0 disables
+	ErrorRate           float64       // open when failures/calls of the window reaches it, 0 disables
+	MinRequests         int           // calls needed in the window before ErrorRate applies
+	Window              time.Duration // period the calls are counted for ErrorRate
+	OpenTimeout         time.Duration // how long to stay open before a probe call
+	// IsFailure reports whether err counts as a failure of the server, nil means
+	// unavailable servers, timeouts and panics count, application errors don't.
+	IsFailure func(err error) bool
+}
+
+// DefaultBreakerConfig opens after 5 failures in a row or
+// half of at least 20 calls failed within 10s, for 5s.
+var DefaultBreakerConfig = &BreakerConfig{
+	ConsecutiveFailures: 5,
+	ErrorRate:           0.5,
+	MinRequests:         20,
+	Window:              10 * time.Second,
+	OpenTimeout:         5 * time.Second,
+}
+
+func (cfg *BreakerConfig) isFailure(err error) bool {
+	if cfg.IsFailure != nil {
+		return cfg.IsFailure(err)
+	}
+	return IsRetryable(err) || errors.Is(err, ErrDeadlineExceeded) || errors.Is(err, ErrInternal)
+}
+
+// BreakerStats is a snapshot of the circuit breaker of a server
+type BreakerStats struct {
+	Addr                string
+	State               BreakerState
+	Requests            int // calls in the current window
+	Failures            int // failed calls in the current window
+	ConsecutiveFailures int
+	OpenedAt            time.Time // when it was last opened
+}
+
+type breaker struct {
+	cfg *BreakerConfig
+
+	mu          sync.Mutex // protect following
+	state       BreakerState
+	probing     bool // the probe call of half-open state is in flight
+	consecutive int
+	requests    int
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+}
+
+// available reports whether a call may be let through, without taking the probe
+func (b *breaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case StateOpen:
+		return time.Since(b.openedAt) >= b.cfg.OpenTimeout
+	case StateHalfOpen:
+		return !b.probing
+	default:
+		return true
+	}
+}
+
+// acquire reports whether a call is let through, it takes the probe in half-open state
+func (b *breaker) acquire() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == StateOpen && time.Since(b.openedAt) >= b.cfg.OpenTimeout {
+		b.state, b.probing = StateHalfOpen, false
+	}
+	switch b.state {
+	case StateOpen:
+		return false
+	case StateHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// record updates the breaker with the result of a call let through by acquire,
+// calls that weren't sent to the server, e.g. refused by a retired connection, are ignored.
+func (b *breaker) record(err error) {
+	var ns notSentError
+	notSent := errors.As(err, &ns)
+	failed := err != nil && !notSent && b.cfg.isFailure(err)
+	ignored := notSent || (err != nil && !failed && errors.Is(err, ErrCanceled))
+	b.update(failed, ignored)
+}
+
+// update counts a call let through by acquire, unless it's ignored
+func (b *breaker) update(failed, ignored bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case StateOpen:
+		return // a call started before the breaker opened
+	case StateHalfOpen:
+		b.probing = false
+		if failed {
+			b.open(now)
+		} else if !ignored {
+			b.state, b.consecutive, b.requests, b.failures, b.windowStart = StateClosed, 0, 0, 0, now
+		}
+		return
+	}
+	if now.Sub(b.windowStart) >= b.cfg.Window {
+		b.requests, b.failures, b.windowStart = 0, 0, now
+	}
+	if ignored {
+		return
+	}
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+	if (b.cfg.ConsecutiveFailures > 0 && b.consecutive >= b.cfg.ConsecutiveFailures) ||
+		(b.cfg.ErrorRate > 0 && b.requests >= b.cfg.MinRequests && float64(b.failures) >= b.cfg.ErrorRate*float64(b.requests)) {
+		b.open(now)
+	}
+}
+
+func (b *breaker) open(now time.Time) {
+	b.state, b.openedAt = StateOpen, now
+}
+
+// SetBreaker enables a circuit breaker per server configured by cfg, nil disables them.
+// Servers whose breaker is open are skipped by selection.
+// It should be called before any call is made.
+func (xc *XClient) SetBreaker(cfg *BreakerConfig) {
+	xc.breakerConfig = cfg
+}
+
+// breaker returns the breaker of rpcAddr, nil if breakers are disabled
+func (xc *XClient) breaker(rpcAddr string) *breaker {
+	if xc.breakerConfig == nil {
+		return nil
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	b := xc.breakers[rpcAddr]
+	if b == nil {
+		b = &breaker{cfg: xc.breakerConfig, windowStart: time.Now()}
+		xc.breakers[rpcAddr] = b
+	}
+	return b
+}
+
+// available reports whether rpcAddr may be selected
+func (xc *XClient) available(rpcAddr string) bool {
+	b := xc.breaker(rpcAddr)
+	return b == nil || b.available()
+}
+
+// availableServers returns the servers whose circuit breaker isn't open
+func (xc *XClient) availableServers(servers []string) []string {
+	available := make([]string, 0, len(servers))
+	for _, rpcAddr := range servers {
+		if xc.available(rpcAddr) {
+			available = append(available, rpcAddr)
+		}
+	}
+	return available
+}
+
+// BreakerStats returns the state of the circuit breakers, sorted by address
+func (xc *XClient) BreakerStats() []BreakerStats {
+	xc.mu.Lock()
+	breakers := make(map[string]*breaker, len(xc.breakers))
+	for rpcAddr, b := range xc.breakers {
+		breakers[rpcAddr] = b
+	}
+	xc.mu.Unlock()
+	stats := make([]BreakerStats, 0, len(breakers))
+	for rpcAddr, b := range breakers {
+		b.mu.Lock()
+		state := b.state
+		if state == StateOpen && time.Since(b.openedAt) >= b.cfg.OpenTimeout {
+			state = StateHalfOpen
+		}
+		stats = append(stats, BreakerStats{
+			Addr:                rpcAddr,
+			State:               state,
+			Requests:            b.requests,
+			Failures:            b.failures,
+			ConsecutiveFailures: b.consecutive,
+			OpenedAt:            b.openedAt,
+		})
+		b.mu.Unlock()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+	return stats
+}
+
+const breakerText = `<html>
+	<body>
+	<title>GeeRPC XClient</title>
+	<hr>
+	Circuit breakers
+	<hr>
+		<table>
+		<th align=center>Server</th><th align=center>State</th><th align=center>Requests</th><th align=center>Failures</th><th align=center>Consecutive failures</th><th align=center>Opened at</th>
+		{{range .}}
+			<tr>
+			<td align=left font=fixed>{{.Addr}}</td>
+			<td align=center>{{.State}}</td>
+			<td align=center>{{.Requests}}</td>
+			<td align=center>{{.Failures}}</td>
+			<td align=center>{{.ConsecutiveFailures}}</td>
+			<td align=center>{{if not .OpenedAt.IsZero}}{{.OpenedAt.Format "15:04:05"}}{{end}}</td>
+			</tr>
+		{{end}}
+		</table>
+	</body>
+	</html>`
+
+var breakerDebug = template.Must(template.New("XClient debug").Parse(breakerText))
+
+// ServeHTTP shows the circuit breakers of xc, e.g.
+//
+//	http.Handle("/debug/geerpc/xclient", xc)
+func (xc *XClient) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	if err := breakerDebug.Execute(w, xc.BreakerStats()); err != nil {
+		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
+	}
+}
@@ -11,8 +11,12 @@ import (
 type SelectMode int
 
 const (
-	RandomSelect     SelectMode = iota // select randomly
-	RoundRobinSelect                   // select using Robbin algorithm
+	RandomSelect             SelectMode = iota // select randomly
+	RoundRobinSelect                           // select using Robbin algorithm
+	WeightedRoundRobinSelect                   // select using smooth weighted round robin, see UpdateWeights
+	LeastPendingSelect                         // select the server with the fewest pending calls, XClient only
+	P2CSelect                                  // select the better of two random servers by latency and load, XClient only
+	ConsistentHashSelect                       // select by the routing key of the call, see WithRoutingKey, XClient only
 )
 
 type Discovery interface {
@@ -30,7 +34,9 @@ type MultiServersDiscovery struct {
 	r       *rand.Rand   // generate random number
 	mu      sync.RWMutex // protect following
 	servers []string
-	index   int // record the selected position for robin algorithm
+	index   int            // record the selected position for robin algorithm
+	weights map[string]int // weight of servers for weighted round robin, 1 if missing
+	current map[string]int // current weight of servers for weighted round robin
 }
 
 // Refresh doesn't make sense for MultiServersDiscovery, so ignore it
@@ -42,10 +48,28 @@ func (d *MultiServersDiscovery) Refresh() error {
 func (d *MultiServersDiscovery) Update(servers []string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.servers = servers
+	d.setServers(servers)
 	return nil
 }
 
+// setServers replaces the servers and forgets the current weights of
+// the removed ones, it must be called with d.mu held.
+func (d *MultiServersDiscovery) setServers(servers []string) {
+	d.servers = servers
+	if len(d.current) == 0 {
+		return
+	}
+	kept := make(map[string]bool, len(servers))
+	for _, s := range servers {
+		kept[s] = true
+	}
+	for s := range d.current {
+		if !kept[s] {
+			delete(d.current, s)
+		}
+	}
+}
+
 // Get a server according to mode
 func (d *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
 	d.mu.Lock()
@@ -61,11 +85,44 @@ func (d *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
 		s := d.servers[d.index%n] // servers could be updated, so mode n to ensure safety
 		d.index = (d.index + 1) % n
 		return s, nil
+	case WeightedRoundRobinSelect:
+		return d.nextWeighted(), nil
 	default:
 		return "", errors.New("rpc discovery: not supported select mode")
 	}
 }
 
+// UpdateWeights sets the weights of servers for WeightedRoundRobinSelect,
+// servers missing from weights have a weight of 1.
+func (d *MultiServersDiscovery) UpdateWeights(weights map[string]int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.weights = weights
+}
+
+// nextWeighted selects a server by smooth weighted round robin, like nginx:
+// every server gains its weight, the one with the highest current weight
+// is selected and loses the total weight.
+func (d *MultiServersDiscovery) nextWeighted() string {
+	if d.current == nil {
+		d.current = make(map[string]int)
+	}
+	total, best := 0, ""
+	for _, s := range d.servers {
+		w := d.weights[s]
+		if w < 1 {
+			w = 1
+		}
+		d.current[s] += w
+		total += w
+		if best == "" || d.current[s] > d.current[best] {
+			best = s
+		}
+	}
+	d.current[best] -= total
+	return best
+}
+
 // returns all servers in discovery
 func (d *MultiServersDiscovery) GetAll() ([]string, error) {
 	d.mu.RLock()
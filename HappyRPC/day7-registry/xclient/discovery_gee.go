@@ -1,74 +1,188 @@
 package xclient
 
 import (
+	"context"
+	"geerpc/registry"
 	"log"
-	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
+// GeeRegistryDiscovery discovers servers from a GeeRegistry. It watches the
+// registry in background, so that membership changes are seen within
+// milliseconds and Get and GetAll never wait for the registry, except for
+// the first servers after creation.
+// Given the registries of a cluster, it fails over among them.
 type GeeRegistryDiscovery struct {
 	*MultiServersDiscovery
-	registry   string
-	timeout    time.Duration
-	lastUpdate time.Time
+	registry     string        // URLs of the registries separated by commas
+	registries   []string      // registry split
+	current      int           // index of the registry watched
+	service      string        // only servers of service are discovered, all servers if empty
+	watchTimeout time.Duration // how long a watch waits for changes
+	ready        chan struct{} // closed once the first servers are fetched
+	readyOnce    sync.Once
+	cancel       context.CancelFunc // stop watching
+	lastUpdate   time.Time
+	revision     uint64 // revision of the registry the servers are up to date with
+	synced       bool   // revision is of the registry watched
+	err          error  // error of the last fetch, nil once servers are fetched
 }
 
-const defaultUpdateTimeout = time.Second * 10
+const (
+	defaultWatchTimeout = time.Second * 10
+	maxWatchBackoff     = time.Second * 10
+)
 
 func (d *GeeRegistryDiscovery) Update(servers []string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.servers = servers
+	d.setServers(servers)
 	d.lastUpdate = time.Now()
 	return nil
 }
 
+// Refresh fetches the servers from the registry at once,
+// it's only needed to bypass watching, e.g. right after a change.
 func (d *GeeRegistryDiscovery) Refresh() error {
+	log.Println("rpc registry: refresh servers from registry", d.registry)
+	list, err := registry.List(d.registry, d.service)
+	d.apply(list, err)
+	if err == nil {
+		d.mu.Lock()
+		d.synced = false // list may come from a registry other than the one watched
+		d.mu.Unlock()
+	}
+	return err
+}
+
+// apply updates the servers with the result of fetching them from the registry
+func (d *GeeRegistryDiscovery) apply(list *registry.ServiceList, err error) {
+	defer d.readyOnce.Do(func() { close(d.ready) })
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	if d.lastUpdate.Add(d.timeout).After(time.Now()) {
-		return nil
-	}
-	log.Println("rpc registry: refresh servers from registry", d.registry)
-	resp, err := http.Get(d.registry)
 	if err != nil {
 		log.Println("rpc registry refresh err:", err)
-		return err
+		if d.lastUpdate.IsZero() {
+			d.err = err
+		}
+		return
 	}
-	servers := strings.Split(resp.Header.Get("X-Geerpc-Servers"), ",")
-	d.servers = make([]string, 0, len(servers))
-	for _, server := range servers {
-		if strings.TrimSpace(server) != "" {
-			d.servers = append(d.servers, strings.TrimSpace(server))
+	servers := make([]string, 0, len(list.Servers))
+	d.weights = make(map[string]int)
+	for _, item := range list.Servers {
+		if n := len(servers); n > 0 && servers[n-1] == item.Addr {
+			continue // registered for several services
+		}
+		servers = append(servers, item.Addr)
+		if item.Weight > 0 {
+			d.weights[item.Addr] = item.Weight
 		}
 	}
-	d.lastUpdate = time.Now()
-	return nil
+	d.setServers(servers)
+	// the registry may have restarted with a smaller revision, follow it
+	d.revision, d.synced, d.lastUpdate, d.err = list.Revision, true, time.Now(), nil
+}
+
+// watch long-polls the registry for changes until ctx is done
+func (d *GeeRegistryDiscovery) watch(ctx context.Context) {
+	backoff, failures := time.Duration(0), 0
+	for ctx.Err() == nil {
+		d.mu.RLock()
+		current, revision, synced := d.registries[d.current], d.revision, d.synced
+		d.mu.RUnlock()
+		var list *registry.ServiceList
+		var err error
+		if synced {
+			list, err = registry.Watch(ctx, current, d.service, revision, d.watchTimeout)
+		} else {
+			list, err = registry.List(current, d.service)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			d.apply(list, nil)
+			backoff, failures = 0, 0
+			continue
+		}
+		// fail over to the next registry, whose revisions are its own
+		d.mu.Lock()
+		d.current = (d.current + 1) % len(d.registries)
+		d.synced = false
+		d.mu.Unlock()
+		if failures++; failures%len(d.registries) != 0 {
+			continue
+		}
+		d.apply(nil, err) // every registry failed
+		// don't hammer unavailable registries
+		backoff = backoff*2 + 100*time.Millisecond
+		if backoff > maxWatchBackoff {
+			backoff = maxWatchBackoff
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// wait waits for the first servers, it returns the error of fetching them if failed
+func (d *GeeRegistryDiscovery) wait() error {
+	<-d.ready
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.err
 }
 
 func (d *GeeRegistryDiscovery) Get(mode SelectMode) (string, error) {
-	if err := d.Refresh(); err != nil {
+	if err := d.wait(); err != nil {
 		return "", err
 	}
 	return d.MultiServersDiscovery.Get(mode)
 }
 
 func (d *GeeRegistryDiscovery) GetAll() ([]string, error) {
-	if err := d.Refresh(); err != nil {
+	if err := d.wait(); err != nil {
 		return nil, err
 	}
 	return d.MultiServersDiscovery.GetAll()
 }
 
-func NewGeeRegistryDiscovery(registerAddr string, timeout time.Duration) *GeeRegistryDiscovery {
-	if timeout == 0 {
-		timeout = defaultUpdateTimeout
+// Close stops watching the registry
+func (d *GeeRegistryDiscovery) Close() error {
+	d.cancel()
+	return nil
+}
+
+// NewGeeRegistryDiscovery returns a discovery of the servers registered in the registry
+// at registerAddr, which it watches for watchTimeout at a time, 10s if watchTimeout is 0.
+// registerAddr may be the URLs of the registries of a cluster separated by commas.
+// It should be closed once it's no longer used.
+//
+// watchTimeout used to be how long the servers were cached before being fetched again,
+// they are now updated as soon as they change, whatever watchTimeout is.
+func NewGeeRegistryDiscovery(registerAddr string, watchTimeout time.Duration) *GeeRegistryDiscovery {
+	return NewGeeServiceDiscovery(registerAddr, "", watchTimeout)
+}
+
+// NewGeeServiceDiscovery is like NewGeeRegistryDiscovery, and discovers
+// only the servers registered for service, e.g. by registry.HeartbeatService.
+func NewGeeServiceDiscovery(registerAddr, service string, watchTimeout time.Duration) *GeeRegistryDiscovery {
+	if watchTimeout == 0 {
+		watchTimeout = defaultWatchTimeout
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	d := &GeeRegistryDiscovery{
 		MultiServersDiscovery: NewMultiServerDiscovery(make([]string, 0)),
 		registry:              registerAddr,
-		timeout:               timeout,
+		registries:            strings.Split(registerAddr, ","),
+		service:               service,
+		watchTimeout:          watchTimeout,
+		ready:                 make(chan struct{}),
+		cancel:                cancel,
 	}
+	go d.watch(ctx)
 	return d
 }
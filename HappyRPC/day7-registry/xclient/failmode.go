@@ -0,0 +1,128 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+)
+
+// FailMode decides what XClient.Call does when a call fails or is slow
+type FailMode int
+
+const (
+	Failover   FailMode = iota // retry on another server according to the RetryPolicy
+	Failfast                   // return the first error
+	Failtry                    // retry on the same server according to the RetryPolicy
+	Failbackup                 // call another server if the first one hasn't replied within the backup latency, first success wins
+	Forking                    // call all servers at once, first success wins
+)
+
+// defaultBackupLatency is how long Failbackup waits before sending the backup request
+const defaultBackupLatency = 10 * time.Millisecond
+
+// SetFailMode sets the FailMode of xc, Failover by default.
+// Failbackup and Forking may call a method more than once, so they
+// should only be used with idempotent methods.
+// It should be called before any call is made.
+func (xc *XClient) SetFailMode(mode FailMode) {
+	xc.failMode = mode
+}
+
+// SetBackupLatency sets how long Failbackup waits before sending the backup request
+func (xc *XClient) SetBackupLatency(d time.Duration) {
+	xc.backupLatency = d
+}
+
+// cloneReply returns a new value of the type reply points to, nil if reply is nil
+func cloneReply(reply interface{}) interface{} {
+	if reply == nil {
+		return nil
+	}
+	return reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+}
+
+type callResult struct {
+	reply interface{}
+	err   error
+}
+
+// callFirst calls the servers one after another, starting the next call after
+// delay or as soon as all started calls failed, or all at once if delay is 0.
+// It returns once a call succeeds and cancels the others,
+// or returns the last error if all calls failed.
+func (xc *XClient) callFirst(ctx context.Context, servers []string, delay time.Duration, serviceMethod string, args, reply interface{}) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan callResult, len(servers))
+	started, done := 0, 0
+	var timer <-chan time.Time
+	startNext := func() {
+		rpcAddr, clonedReply := servers[started], cloneReply(reply)
+		started++
+		go func() {
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			results <- callResult{clonedReply, err}
+		}()
+		timer = nil
+		if delay > 0 && started < len(servers) {
+			timer = time.After(delay)
+		}
+	}
+	startNext()
+	for delay == 0 && started < len(servers) {
+		startNext()
+	}
+	var err error
+	for done < started {
+		select {
+		case r := <-results:
+			done++
+			if r.err == nil {
+				if reply != nil {
+					reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(r.reply).Elem())
+				}
+				return nil
+			}
+			err = r.err
+			if done == started && started < len(servers) {
+				startNext()
+			}
+		case <-timer:
+			startNext()
+		}
+	}
+	return err
+}
+
+// callBackup calls a server, and another one if the first one is slow
+func (xc *XClient) callBackup(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	first, err := xc.selectServer(ctx, nil)
+	if err != nil {
+		return err
+	}
+	servers := []string{first}
+	if backup, err := xc.selectServer(ctx, map[string]bool{first: true}); err == nil && backup != first {
+		servers = append(servers, backup)
+	}
+	delay := xc.backupLatency
+	if delay <= 0 {
+		delay = defaultBackupLatency
+	}
+	return xc.callFirst(ctx, servers, delay, serviceMethod, args, reply)
+}
+
+// callForking calls all servers at once, except those whose circuit breaker is open
+func (xc *XClient) callForking(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return err
+	}
+	if len(servers) == 0 {
+		return errors.New("rpc discovery: no available servers")
+	}
+	if servers = xc.availableServers(servers); len(servers) == 0 {
+		return ErrBreakerOpen
+	}
+	return xc.callFirst(ctx, servers, 0, serviceMethod, args, reply)
+}
@@ -0,0 +1,175 @@
+package xclient
+
+import (
+	. "geerpc"
+	"time"
+)
+
+// PoolSelect decides which connection of a pool a call goes through
+type PoolSelect int
+
+const (
+	PoolRoundRobin   PoolSelect = iota // use the connections in turn
+	PoolLeastPending                   // use the connection with the fewest pending calls
+)
+
+// PoolConfig configures the connections XClient keeps to every server
+type PoolConfig struct {
+	Size        int           // connections per server, at least 1
+	Select      PoolSelect    // how a connection is selected for a call
+	IdleTimeout time.Duration // close connections unused for this long, 0 disables
+	// MaxLifetime replaces connections older than it, so that load balancers in
+	// front of the servers redistribute them. 0 disables.
+	MaxLifetime time.Duration
+}
+
+var defaultPoolConfig = &PoolConfig{Size: 1}
+
+// minReapInterval bounds how often connections are reaped, however short
+// IdleTimeout and MaxLifetime are.
+const minReapInterval = time.Millisecond
+
+type pooledClient struct {
+	*Client
+	created  time.Time
+	lastUsed time.Time
+}
+
+// pool is the connections to a server, it's protected by XClient.mu
+type pool struct {
+	conns   []*pooledClient
+	retired []*Client // replaced connections, closed once their calls are done
+	next    int       // next connection for PoolRoundRobin
+	dialing int       // connections being dialed without holding XClient.mu
+}
+
+// SetPool makes xc keep connections to every server as configured by cfg.
+// It should be called before any call is made.
+func (xc *XClient) SetPool(cfg *PoolConfig) {
+	xc.pool = cfg
+	if (cfg.IdleTimeout > 0 || cfg.MaxLifetime > 0) && xc.stopReaper == nil {
+		interval := cfg.IdleTimeout
+		if interval == 0 || (cfg.MaxLifetime > 0 && cfg.MaxLifetime < interval) {
+			interval = cfg.MaxLifetime
+		}
+		if interval /= 2; interval < minReapInterval {
+			interval = minReapInterval
+		}
+		xc.stopReaper = make(chan struct{})
+		go xc.reap(interval, xc.stopReaper)
+	}
+}
+
+func (xc *XClient) poolConfig() *PoolConfig {
+	if xc.pool == nil || xc.pool.Size < 1 {
+		return defaultPoolConfig
+	}
+	return xc.pool
+}
+
+// prune retires the connections that are unavailable or too old,
+// and returns the retired connections without pending calls, which the
+// caller closes once it has released XClient.mu.
+func (p *pool) prune(cfg *PoolConfig, now time.Time) (closing []*Client) {
+	conns := p.conns[:0]
+	for _, pc := range p.conns {
+		if !pc.IsAvailable() || (cfg.MaxLifetime > 0 && now.Sub(pc.created) >= cfg.MaxLifetime) {
+			p.retired = append(p.retired, pc.Client)
+			continue
+		}
+		conns = append(conns, pc)
+	}
+	p.conns = conns
+	retired := p.retired[:0]
+	for _, client := range p.retired {
+		if client.NumPending() > 0 {
+			retired = append(retired, client)
+			continue
+		}
+		closing = append(closing, client)
+	}
+	p.retired = retired
+	return closing
+}
+
+func (p *pool) pick(mode PoolSelect) *pooledClient {
+	if mode == PoolLeastPending {
+		best, min := p.conns[0], -1
+		for _, pc := range p.conns {
+			if n := pc.NumPending(); min < 0 || n < min {
+				best, min = pc, n
+			}
+		}
+		return best
+	}
+	pc := p.conns[p.next%len(p.conns)]
+	p.next = (p.next + 1) % len(p.conns)
+	return pc
+}
+
+// use picks a connection and marks it used
+func (p *pool) use(mode PoolSelect) *Client {
+	pc := p.pick(mode)
+	pc.lastUsed = time.Now()
+	return pc.Client
+}
+
+func (p *pool) numPending() int {
+	n := 0
+	for _, pc := range p.conns {
+		n += pc.NumPending()
+	}
+	return n
+}
+
+// clear removes all the connections of the pool and returns them to be closed
+func (p *pool) clear() []*Client {
+	clients := p.retired
+	for _, pc := range p.conns {
+		clients = append(clients, pc.Client)
+	}
+	p.conns, p.retired = nil, nil
+	return clients
+}
+
+// closeClients closes clients, which may wait for their queued messages to be sent
+func closeClients(clients []*Client) {
+	for _, client := range clients {
+		_ = client.Close()
+	}
+}
+
+// reap closes idle and retired connections every interval until stop is closed
+func (xc *XClient) reap(interval time.Duration, stop chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		cfg, now := xc.poolConfig(), time.Now()
+		var closing []*Client
+		xc.mu.Lock()
+		for rpcAddr, p := range xc.pools {
+			closing = append(closing, p.prune(cfg, now)...)
+			if cfg.IdleTimeout > 0 {
+				conns := p.conns[:0]
+				for _, pc := range p.conns {
+					if now.Sub(pc.lastUsed) >= cfg.IdleTimeout && pc.NumPending() == 0 {
+						closing = append(closing, pc.Client)
+						continue
+					}
+					conns = append(conns, pc)
+				}
+				p.conns = conns
+			}
+			if len(p.conns) == 0 && len(p.retired) == 0 && p.dialing == 0 {
+				delete(xc.pools, rpcAddr)
+			}
+		}
+		xc.mu.Unlock()
+		closeClients(closing)
+	}
+}
@@ -0,0 +1,164 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	. "geerpc"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// RetryPolicy decides how XClient.Call retries a failed call on another server.
+// Calls of methods marked idempotent are retried on retryable errors, other
+// calls are only retried when they couldn't be sent, e.g. the server is down.
+type RetryPolicy struct {
+	MaxAttempts    int           // attempts including the first one, <= 1 disables retries
+	InitialBackoff time.Duration // wait before the first retry
+	MaxBackoff     time.Duration // upper bound of the wait
+	Multiplier     float64       // growth of the wait after each retry
+	Jitter         float64       // randomize the wait by ±Jitter, e.g. 0.2 for ±20%
+	// Retryable reports whether a call failed with err may succeed on another server,
+	// nil means IsRetryable.
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy makes 3 attempts waiting 50ms then 100ms, ±20%
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// IsRetryable reports whether err means the server or the connection is unavailable,
+// application errors and errors of the caller's context aren't retryable.
+func IsRetryable(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, ErrShutdown) ||
+		errors.Is(err, ErrServerClosed) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, ErrPingTimeout) ||
+		errors.As(err, &netErr)
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// backoff returns the wait before the retry-th retry, starting from 1
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	d := float64(p.InitialBackoff)
+	for i := 1; i < retry; i++ {
+		d *= p.Multiplier
+	}
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	return time.Duration(d)
+}
+
+// SetRetryPolicy makes xc retry failed calls according to p, nil disables retries.
+// It should be called before any call is made.
+func (xc *XClient) SetRetryPolicy(p *RetryPolicy) {
+	xc.retry = p
+}
+
+// Idempotent marks serviceMethods as safe to call more than once,
+// so their calls are retried on any retryable error.
+// It should be called before any call is made.
+func (xc *XClient) Idempotent(serviceMethods ...string) {
+	if xc.idempotent == nil {
+		xc.idempotent = make(map[string]bool)
+	}
+	for _, m := range serviceMethods {
+		xc.idempotent[m] = true
+	}
+}
+
+// selectServer selects a server not tried yet, or any server if all have been tried,
+// servers whose circuit breaker is open are skipped.
+func (xc *XClient) selectServer(ctx context.Context, tried map[string]bool) (string, error) {
+	if len(tried) == 0 && !isBalanced(xc.mode) && xc.breakerConfig == nil {
+		return xc.d.Get(xc.mode)
+	}
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return "", err
+	}
+	if len(servers) == 0 {
+		return "", errors.New("rpc discovery: no available servers")
+	}
+	for _, skipTried := range []bool{true, false} {
+		usable := func(rpcAddr string) bool {
+			return !(skipTried && tried[rpcAddr]) && xc.available(rpcAddr)
+		}
+		if isBalanced(xc.mode) {
+			candidates := make([]string, 0, len(servers))
+			for _, rpcAddr := range servers {
+				if usable(rpcAddr) {
+					candidates = append(candidates, rpcAddr)
+				}
+			}
+			if len(candidates) > 0 {
+				return xc.balance(ctx, candidates), nil
+			}
+			continue
+		}
+		for range servers {
+			rpcAddr, err := xc.d.Get(xc.mode)
+			if err != nil {
+				return "", err
+			}
+			if usable(rpcAddr) {
+				return rpcAddr, nil
+			}
+		}
+		for _, rpcAddr := range servers {
+			if usable(rpcAddr) {
+				return rpcAddr, nil
+			}
+		}
+	}
+	return "", ErrBreakerOpen
+}
+
+// callWithRetry calls a server selected by xc, and retries on other servers,
+// or on the same server for Failtry
+func (xc *XClient) callWithRetry(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	tried := make(map[string]bool)
+	var rpcAddr string
+	for attempt := 1; ; attempt++ {
+		if attempt == 1 || xc.failMode != Failtry {
+			var err error
+			if rpcAddr, err = xc.selectServer(ctx, tried); err != nil {
+				return err
+			}
+			tried[rpcAddr] = true
+		}
+		err := xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+		var ns notSentError
+		sent := !errors.As(err, &ns)
+		p := xc.retry
+		if err == nil || p == nil || xc.failMode == Failfast || attempt >= p.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+		if sent && !(xc.idempotent[serviceMethod] && p.retryable(err)) {
+			return err
+		}
+		timer := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
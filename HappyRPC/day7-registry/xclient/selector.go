@@ -0,0 +1,114 @@
+package xclient
+
+import (
+	"context"
+	"geecache/consistenthash"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ewmaDecay is the weight of the latest latency in the moving average
+const ewmaDecay = 0.3
+
+// hashReplicas is the number of virtual nodes of a server on the hash ring
+const hashReplicas = 50
+
+type routingKey struct{}
+
+// WithRoutingKey returns a context making ConsistentHashSelect route the call by key,
+// calls with the same key go to the same server as long as it's alive.
+func WithRoutingKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, routingKey{}, key)
+}
+
+// balancer keeps the state of the select modes implemented by XClient
+type balancer struct {
+	mu      sync.Mutex // protect following
+	r       *rand.Rand
+	latency map[string]float64 // moving average of the latency of servers in nanoseconds
+	ring    *consistenthash.Map
+	ringKey string // servers of ring
+}
+
+func newBalancer() *balancer {
+	return &balancer{
+		r:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		latency: make(map[string]float64),
+	}
+}
+
+// observe records the latency of a call to rpcAddr
+func (b *balancer) observe(rpcAddr string, d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if avg, ok := b.latency[rpcAddr]; ok {
+		b.latency[rpcAddr] = ewmaDecay*float64(d) + (1-ewmaDecay)*avg
+	} else {
+		b.latency[rpcAddr] = float64(d)
+	}
+}
+
+// isBalanced reports whether mode is implemented by XClient instead of Discovery
+func isBalanced(mode SelectMode) bool {
+	return mode == LeastPendingSelect || mode == P2CSelect || mode == ConsistentHashSelect
+}
+
+// balance selects one of servers according to the mode of xc
+func (xc *XClient) balance(ctx context.Context, servers []string) string {
+	b := xc.balancer
+	switch xc.mode {
+	case LeastPendingSelect:
+		best, min := servers[0], -1
+		for _, s := range servers {
+			if n := xc.numPending(s); min < 0 || n < min {
+				best, min = s, n
+			}
+		}
+		return best
+	case P2CSelect:
+		b.mu.Lock()
+		i := b.r.Intn(len(servers))
+		j := b.r.Intn(len(servers))
+		b.mu.Unlock()
+		a, c := servers[i], servers[j]
+		if xc.load(c) < xc.load(a) {
+			return c
+		}
+		return a
+	default: // ConsistentHashSelect
+		key, ok := ctx.Value(routingKey{}).(string)
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if !ok {
+			return servers[b.r.Intn(len(servers))]
+		}
+		if ringKey := strings.Join(servers, ","); b.ring == nil || b.ringKey != ringKey {
+			b.ring = consistenthash.New(hashReplicas, nil)
+			b.ring.Add(servers...)
+			b.ringKey = ringKey
+		}
+		return b.ring.Get(key)
+	}
+}
+
+// numPending returns the number of calls waiting for rpcAddr
+func (xc *XClient) numPending(rpcAddr string) int {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if p := xc.pools[rpcAddr]; p != nil {
+		return p.numPending()
+	}
+	return 0
+}
+
+// load scores rpcAddr for P2CSelect by its latency and pending calls, lower is better.
+// Servers never called score 0 so that they get tried.
+func (xc *XClient) load(rpcAddr string) float64 {
+	b := xc.balancer
+	b.mu.Lock()
+	latency := b.latency[rpcAddr]
+	b.mu.Unlock()
+	return latency * float64(xc.numPending(rpcAddr)+1)
+}
@@ -2,96 +2,198 @@ package xclient
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	. "geerpc"
 	"io"
 	"reflect"
 	"sync"
+	"time"
 )
 
 type XClient struct {
-	d       Discovery
-	mode    SelectMode
-	opt     *Option
-	mu      sync.Mutex // protect following
-	clients map[string]*Client
+	d             Discovery
+	mode          SelectMode
+	opt           *Option
+	interceptors  []UnaryClientInterceptor
+	retry         *RetryPolicy
+	idempotent    map[string]bool
+	failMode      FailMode
+	backupLatency time.Duration
+	balancer      *balancer
+	breakerConfig *BreakerConfig
+	pool          *PoolConfig
+	mu            sync.Mutex // protect following
+	pools         map[string]*pool
+	breakers      map[string]*breaker
+	stopReaper    chan struct{} // stop reaping idle connections
 }
 
 var _ io.Closer = (*XClient)(nil)
 
 func NewXClient(d Discovery, mode SelectMode, opt *Option) *XClient {
-	return &XClient{d: d, mode: mode, opt: opt, clients: make(map[string]*Client)}
+	return &XClient{
+		d:        d,
+		mode:     mode,
+		opt:      opt,
+		retry:    DefaultRetryPolicy,
+		balancer: newBalancer(),
+		pools:    make(map[string]*pool),
+		breakers: make(map[string]*breaker),
+	}
+}
+
+// Use appends interceptors to every client dialed by xc,
+// it should be called before any call is made.
+func (xc *XClient) Use(interceptors ...UnaryClientInterceptor) {
+	xc.interceptors = append(xc.interceptors, interceptors...)
 }
 
 func (xc *XClient) Close() error {
+	var closing []*Client
 	xc.mu.Lock()
-	defer xc.mu.Unlock()
-	for key, client := range xc.clients {
-		// I have no idea how to deal with error, just ignore it.
-		_ = client.Close()
-		delete(xc.clients, key)
+	for key, p := range xc.pools {
+		closing = append(closing, p.clear()...)
+		delete(xc.pools, key)
 	}
+	if xc.stopReaper != nil {
+		close(xc.stopReaper)
+		xc.stopReaper = nil
+	}
+	xc.mu.Unlock()
+	// I have no idea how to deal with error, just ignore it.
+	closeClients(closing)
 	return nil
 }
 
+// dial returns a connection to rpcAddr from its pool,
+// a new connection is dialed if the pool isn't full.
+// xc.mu isn't held while dialing, so a slow server doesn't hold up the others.
 func (xc *XClient) dial(rpcAddr string) (*Client, error) {
+	cfg := xc.poolConfig()
 	xc.mu.Lock()
-	defer xc.mu.Unlock()
-	client, ok := xc.clients[rpcAddr]
-	if ok && !client.IsAvailable() {
+	p := xc.poolOf(rpcAddr)
+	closing := p.prune(cfg, time.Now())
+	if len(p.conns) > 0 && len(p.conns)+p.dialing >= cfg.Size {
+		client := p.use(cfg.Select)
+		xc.mu.Unlock()
+		closeClients(closing)
+		return client, nil
+	}
+	p.dialing++
+	xc.mu.Unlock()
+	closeClients(closing)
+
+	client, err := XDial(rpcAddr, xc.opt)
+	if err == nil {
+		client.Use(xc.interceptors...)
+	}
+	xc.mu.Lock()
+	p.dialing--
+	p = xc.poolOf(rpcAddr) // the pool may have been removed meanwhile, e.g. by Close
+	if err == nil && len(p.conns) < cfg.Size {
+		now := time.Now()
+		p.conns = append(p.conns, &pooledClient{Client: client, created: now, lastUsed: now})
+		xc.mu.Unlock()
+		return client, nil
+	}
+	if len(p.conns) == 0 {
+		xc.mu.Unlock()
+		return nil, err
+	}
+	// the dial failed or concurrent dials filled the pool, use the connections at hand
+	used := p.use(cfg.Select)
+	xc.mu.Unlock()
+	if client != nil {
 		_ = client.Close()
-		delete(xc.clients, rpcAddr)
-		client = nil
-	}
-	if client == nil {
-		var err error
-		client, err = XDial(rpcAddr, xc.opt)
-		if err != nil {
-			return nil, err
-		}
-		xc.clients[rpcAddr] = client
 	}
-	return client, nil
+	return used, nil
+}
+
+// poolOf returns the pool of rpcAddr, it must be called with xc.mu held
+func (xc *XClient) poolOf(rpcAddr string) *pool {
+	p := xc.pools[rpcAddr]
+	if p == nil {
+		p = new(pool)
+		xc.pools[rpcAddr] = p
+	}
+	return p
+}
+
+// notSentError wraps the error of a call that wasn't sent to the server
+type notSentError struct {
+	error
 }
 
+func (e notSentError) Unwrap() error { return e.error }
+
 func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	b := xc.breaker(rpcAddr)
+	if b != nil && !b.acquire() {
+		return notSentError{fmt.Errorf("%w: %s", ErrBreakerOpen, rpcAddr)}
+	}
 	client, err := xc.dial(rpcAddr)
 	if err != nil {
-		return err
+		if b != nil {
+			b.update(true, false) // the server can't be reached
+		}
+		return notSentError{err}
+	}
+	start := time.Now()
+	err = client.Call(ctx, serviceMethod, args, reply)
+	if errors.Is(err, ErrShutdown) {
+		// the client refused to register the call, e.g. it was retired
+		// and closed by a concurrent dial or the reaper once dial returned
+		err = notSentError{err}
+	} else if ctx.Err() == nil {
+		xc.balancer.observe(rpcAddr, time.Since(start))
+	}
+	if b != nil {
+		b.record(err)
 	}
-	return client.Call(ctx, serviceMethod, args, reply)
+	return err
 }
 
 // Call invokes the named function, waits for it to complete,
 // and returns its error status.
-// xc will choose a proper server.
+// xc will choose a proper server, and handle failures according to its FailMode.
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	rpcAddr, err := xc.d.Get(xc.mode)
-	if err != nil {
-		return err
+	switch xc.failMode {
+	case Failbackup:
+		return xc.callBackup(ctx, serviceMethod, args, reply)
+	case Forking:
+		return xc.callForking(ctx, serviceMethod, args, reply)
+	default:
+		return xc.callWithRetry(ctx, serviceMethod, args, reply)
 	}
-	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
 }
 
-// Broadcast invokes the named function for every server registered in discovery
+// Broadcast invokes the named function for every server registered in discovery,
+// servers whose circuit breaker is open are skipped.
 func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	servers, err := xc.d.GetAll()
+	all, err := xc.d.GetAll()
 	if err != nil {
 		return err
 	}
+	servers := xc.availableServers(all)
+	if len(servers) == 0 && len(all) > 0 {
+		return ErrBreakerOpen
+	}
 	var wg sync.WaitGroup
 	var mu sync.Mutex // protect e and replyDone
 	var e error
 	replyDone := reply == nil // if reply is nil, don't need to set value
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	for _, rpcAddr := range servers {
 		wg.Add(1)
 		go func(rpcAddr string) {
 			defer wg.Done()
-			var clonedReply interface{}
-			if reply != nil {
-				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
-			}
+			clonedReply := cloneReply(reply)
 			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			if errors.Is(err, ErrBreakerOpen) {
+				return // the breaker opened once the servers were filtered
+			}
 			mu.Lock()
 			if err != nil && e == nil {
 				e = err
@@ -107,3 +209,60 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 	wg.Wait()
 	return e
 }
+
+// ErrNoQuorum is returned by BroadcastAll when fewer servers than the quorum succeeded
+var ErrNoQuorum = errors.New("rpc xclient: quorum not reached")
+
+// BroadcastResult is the outcome of a call to one server
+type BroadcastResult struct {
+	Reply interface{} // a new value of the type reply points to, nil if the call failed
+	Err   error
+}
+
+// BroadcastAll invokes the named function for every server registered in discovery,
+// and returns the result of every server keyed by its address. reply is only used
+// as the type of the replies, it's left untouched.
+// If quorum is 0, BroadcastAll waits for all servers and never fails because of them.
+// Otherwise it returns as soon as quorum servers succeed, canceling the other calls,
+// or fails with ErrNoQuorum as soon as the quorum can't be reached anymore.
+// A quorum larger than the number of servers fails with ErrNoQuorum before any call.
+func (xc *XClient) BroadcastAll(ctx context.Context, serviceMethod string, args, reply interface{}, quorum int) (map[string]*BroadcastResult, error) {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	if quorum > len(servers) {
+		return nil, fmt.Errorf("%w: expect %d servers, but only %d are registered", ErrNoQuorum, quorum, len(servers))
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex // protect results, succeeded and failed
+	results := make(map[string]*BroadcastResult, len(servers))
+	succeeded, failed := 0, 0
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for _, rpcAddr := range servers {
+		wg.Add(1)
+		go func(rpcAddr string) {
+			defer wg.Done()
+			clonedReply := cloneReply(reply)
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				clonedReply = nil
+				failed++
+			} else {
+				succeeded++
+			}
+			results[rpcAddr] = &BroadcastResult{Reply: clonedReply, Err: err}
+			if quorum > 0 && (succeeded >= quorum || failed > len(servers)-quorum) {
+				cancel() // the outcome is known, don't wait for the other calls
+			}
+		}(rpcAddr)
+	}
+	wg.Wait()
+	if quorum > 0 && succeeded < quorum {
+		return results, fmt.Errorf("%w: %d of %d servers succeeded, expect %d", ErrNoQuorum, succeeded, len(servers), quorum)
+	}
+	return results, nil
+}
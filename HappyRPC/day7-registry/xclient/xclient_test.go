@@ -0,0 +1,518 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "geerpc"
+	"geerpc/registry"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+// Node answers with its own name, or fails as unavailable if it's down
+type Node struct {
+	name  string
+	down  bool
+	delay time.Duration
+	calls int32
+}
+
+func (n *Node) Name(_ int, reply *string) error {
+	atomic.AddInt32(&n.calls, 1)
+	time.Sleep(n.delay)
+	if n.down {
+		return ErrServerClosed
+	}
+	*reply = n.name
+	return nil
+}
+
+func startNode(node *Node) string {
+	server := NewServer()
+	_ = server.Register(node)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	return "tcp@" + l.Addr().String()
+}
+
+// deadAddr returns an address nobody listens on
+func deadAddr() string {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	_ = l.Close()
+	return "tcp@" + l.Addr().String()
+}
+
+func newTestXClient(servers ...string) *XClient {
+	d := NewMultiServerDiscovery(servers)
+	d.index = 0
+	return NewXClient(d, RoundRobinSelect, nil)
+}
+
+func TestXClient_Retry(t *testing.T) {
+	t.Parallel()
+	up := &Node{name: "up"}
+	upAddr := startNode(up)
+	down := &Node{name: "down", down: true}
+	downAddr := startNode(down)
+
+	t.Run("dial failure", func(t *testing.T) {
+		xc := newTestXClient(deadAddr(), upAddr)
+		defer func() { _ = xc.Close() }()
+		var reply string
+		err := xc.Call(context.Background(), "Node.Name", 0, &reply)
+		_assert(err == nil && reply == "up", "expect a retry on another server, got %q %v", reply, err)
+	})
+	t.Run("not idempotent", func(t *testing.T) {
+		xc := newTestXClient(downAddr, upAddr)
+		defer func() { _ = xc.Close() }()
+		var reply string
+		err := xc.Call(context.Background(), "Node.Name", 0, &reply)
+		_assert(errors.Is(err, ErrServerClosed), "expect no retry of a sent call, got %q %v", reply, err)
+	})
+	t.Run("idempotent", func(t *testing.T) {
+		xc := newTestXClient(downAddr, upAddr)
+		defer func() { _ = xc.Close() }()
+		xc.Idempotent("Node.Name")
+		var reply string
+		err := xc.Call(context.Background(), "Node.Name", 0, &reply)
+		_assert(err == nil && reply == "up", "expect a retry of an idempotent call, got %q %v", reply, err)
+	})
+	t.Run("max attempts", func(t *testing.T) {
+		xc := newTestXClient(downAddr)
+		defer func() { _ = xc.Close() }()
+		xc.Idempotent("Node.Name")
+		xc.SetRetryPolicy(&RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Multiplier: 2})
+		before := atomic.LoadInt32(&down.calls)
+		err := xc.Call(context.Background(), "Node.Name", 0, new(string))
+		_assert(errors.Is(err, ErrServerClosed), "expect the last error, got %v", err)
+		_assert(atomic.LoadInt32(&down.calls)-before == 3, "expect 3 attempts")
+	})
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	p := &RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Multiplier: 2, Jitter: 0.5}
+	for retry, want := range map[int]time.Duration{1: 10 * time.Millisecond, 3: 40 * time.Millisecond, 5: 50 * time.Millisecond} {
+		d := p.backoff(retry)
+		_assert(d >= want/2 && d <= want*3/2, "backoff of retry %d out of range: %s", retry, d)
+	}
+}
+
+func TestXClient_FailMode(t *testing.T) {
+	t.Parallel()
+	up := &Node{name: "up"}
+	upAddr := startNode(up)
+	slow := &Node{name: "slow", delay: time.Second}
+	slowAddr := startNode(slow)
+	down := &Node{name: "down", down: true}
+	downAddr := startNode(down)
+
+	t.Run("failfast", func(t *testing.T) {
+		xc := newTestXClient(deadAddr(), upAddr)
+		defer func() { _ = xc.Close() }()
+		xc.SetFailMode(Failfast)
+		err := xc.Call(context.Background(), "Node.Name", 0, new(string))
+		_assert(err != nil, "expect the dial error")
+	})
+	t.Run("failtry", func(t *testing.T) {
+		xc := newTestXClient(downAddr, upAddr)
+		defer func() { _ = xc.Close() }()
+		xc.SetFailMode(Failtry)
+		xc.Idempotent("Node.Name")
+		xc.SetRetryPolicy(&RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+		before := atomic.LoadInt32(&down.calls)
+		err := xc.Call(context.Background(), "Node.Name", 0, new(string))
+		_assert(errors.Is(err, ErrServerClosed), "expect the error of the same server, got %v", err)
+		_assert(atomic.LoadInt32(&down.calls)-before == 2, "expect 2 attempts on the same server")
+	})
+	t.Run("failbackup", func(t *testing.T) {
+		xc := newTestXClient(slowAddr, upAddr)
+		defer func() { _ = xc.Close() }()
+		xc.SetFailMode(Failbackup)
+		xc.SetBackupLatency(20 * time.Millisecond)
+		start := time.Now()
+		var reply string
+		err := xc.Call(context.Background(), "Node.Name", 0, &reply)
+		_assert(err == nil && reply == "up", "expect the reply of the backup, got %q %v", reply, err)
+		_assert(time.Since(start) < 500*time.Millisecond, "expect not to wait for the slow server")
+	})
+	t.Run("forking", func(t *testing.T) {
+		xc := newTestXClient(downAddr, slowAddr, upAddr)
+		defer func() { _ = xc.Close() }()
+		xc.SetFailMode(Forking)
+		var reply string
+		err := xc.Call(context.Background(), "Node.Name", 0, &reply)
+		_assert(err == nil && reply == "up", "expect the first success, got %q %v", reply, err)
+
+		xc = newTestXClient(downAddr, deadAddr())
+		defer func() { _ = xc.Close() }()
+		xc.SetFailMode(Forking)
+		err = xc.Call(context.Background(), "Node.Name", 0, &reply)
+		_assert(err != nil, "expect an error if all servers fail")
+	})
+}
+
+func TestXClient_BroadcastAll(t *testing.T) {
+	t.Parallel()
+	up1, up2 := startNode(&Node{name: "up1"}), startNode(&Node{name: "up2"})
+	downAddr := startNode(&Node{name: "down", down: true})
+	slowAddr := startNode(&Node{name: "slow", delay: time.Second})
+
+	xc := newTestXClient(up1, up2, downAddr)
+	defer func() { _ = xc.Close() }()
+	results, err := xc.BroadcastAll(context.Background(), "Node.Name", 0, new(string), 0)
+	_assert(err == nil && len(results) == 3, "expect the result of every server, got %v", err)
+	_assert(*results[up1].Reply.(*string) == "up1" && *results[up2].Reply.(*string) == "up2", "expect every reply")
+	_assert(results[downAddr].Reply == nil && errors.Is(results[downAddr].Err, ErrServerClosed), "expect the error of the failed server")
+
+	results, err = xc.BroadcastAll(context.Background(), "Node.Name", 0, new(string), 3)
+	_assert(errors.Is(err, ErrNoQuorum) && len(results) == 3, "expect no quorum, got %v", err)
+	results, err = xc.BroadcastAll(context.Background(), "Node.Name", 0, new(string), 4)
+	_assert(errors.Is(err, ErrNoQuorum) && results == nil, "expect a quorum above the servers rejected, got %v", err)
+
+	xc = newTestXClient(up1, up2, slowAddr)
+	defer func() { _ = xc.Close() }()
+	start := time.Now()
+	results, err = xc.BroadcastAll(context.Background(), "Node.Name", 0, new(string), 2)
+	_assert(err == nil && results[up1].Err == nil && results[up2].Err == nil, "expect quorum of 2, got %v", err)
+	_assert(results[slowAddr].Err != nil && time.Since(start) < 500*time.Millisecond, "expect the slow call canceled")
+}
+
+func TestMultiServersDiscovery_WeightedRoundRobin(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"a", "b", "c"})
+	d.UpdateWeights(map[string]int{"a": 4, "b": 2})
+	var picks []string
+	for i := 0; i < 7; i++ {
+		s, _ := d.Get(WeightedRoundRobinSelect)
+		picks = append(picks, s)
+	}
+	got := strings.Join(picks, "")
+	_assert(got == "abacaba", "expect smooth weighted round robin, got %s", got)
+
+	_ = d.Update([]string{"b", "c"})
+	_assert(len(d.current) == 2 && d.current["a"] == 0, "expect a removed server forgotten, got %v", d.current)
+}
+
+func discoveredWeights(d *GeeRegistryDiscovery) map[string]int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.weights
+}
+
+func TestGeeRegistryDiscovery_Weights(t *testing.T) {
+	r := registry.New(time.Minute)
+	defer func() { _ = r.Close() }()
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	a := registry.HeartbeatWeighted(ts.URL, "tcp@a", 5, time.Minute)
+	defer a.Stop()
+	b := registry.Heartbeat(ts.URL, "tcp@b", time.Minute)
+	defer b.Stop()
+
+	d := NewGeeRegistryDiscovery(ts.URL, time.Minute)
+	defer func() { _ = d.Close() }()
+	servers, err := d.GetAll()
+	_assert(err == nil && len(servers) == 2, "expect 2 servers, got %v %v", servers, err)
+	weights := discoveredWeights(d)
+	_assert(weights["tcp@a"] == 5 && weights["tcp@b"] == 0, "expect weights from registry, got %v", weights)
+}
+
+func TestGeeRegistryDiscovery_Services(t *testing.T) {
+	r := registry.New(time.Minute)
+	defer func() { _ = r.Close() }()
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	a := registry.HeartbeatService(ts.URL, &registry.ServerItem{Service: "Foo", Addr: "tcp@a", Weight: 3, Version: "v2", Zone: "z1"}, time.Minute)
+	defer a.Stop()
+	b := registry.HeartbeatService(ts.URL, &registry.ServerItem{Service: "Bar", Addr: "tcp@b"}, time.Minute)
+	defer b.Stop()
+	c := registry.Heartbeat(ts.URL, "tcp@c", time.Minute)
+	defer c.Stop()
+
+	d := NewGeeServiceDiscovery(ts.URL, "Foo", time.Minute)
+	defer func() { _ = d.Close() }()
+	servers, err := d.GetAll()
+	_assert(err == nil && strings.Join(servers, ",") == "tcp@a,tcp@c", "expect servers of Foo and of every service, got %v %v", servers, err)
+	weights := discoveredWeights(d)
+	_assert(weights["tcp@a"] == 3, "expect weights from registry, got %v", weights)
+	dAll := NewGeeRegistryDiscovery(ts.URL, time.Minute)
+	defer func() { _ = dAll.Close() }()
+	all, err := dAll.GetAll()
+	_assert(err == nil && len(all) == 3, "expect the header API to list all servers, got %v %v", all, err)
+
+	list, err := registry.List(ts.URL, "Foo")
+	_assert(err == nil && len(list.Servers) == 2, "failed to list Foo: %v", err)
+	item := list.Servers[0]
+	_assert(item.Service == "Foo" && item.Version == "v2" && item.Zone == "z1", "expect metadata of tcp@a, got %+v", item)
+
+	watched := make(chan *registry.ServiceList, 1)
+	go func() {
+		list, _ := registry.Watch(context.Background(), ts.URL, "Foo", list.Revision, time.Second)
+		watched <- list
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_assert(registry.Deregister(ts.URL, "Foo", "tcp@a") == nil, "failed to deregister")
+	select {
+	case w := <-watched:
+		_assert(w != nil && w.Revision > list.Revision && len(w.Servers) == 1, "expect the watch to see the deregistration, got %+v", w)
+	case <-time.After(500 * time.Millisecond):
+		_assert(false, "expect the watch to return once the registry changes")
+	}
+	_assert(registry.Deregister(ts.URL, "Foo", "tcp@a") != nil, "expect an error deregistering an unknown server")
+}
+
+func TestGeeRegistryDiscovery_Watch(t *testing.T) {
+	r := registry.New(time.Minute)
+	defer func() { _ = r.Close() }()
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	d := NewGeeServiceDiscovery(ts.URL, "Foo", time.Minute)
+	defer func() { _ = d.Close() }()
+	servers, err := d.GetAll()
+	_assert(err == nil && len(servers) == 0, "expect no servers, got %v %v", servers, err)
+
+	// waitFor polls d and checks that polling never blocks on the registry
+	waitFor := func(expect string) {
+		deadline := time.Now().Add(500 * time.Millisecond)
+		for time.Now().Before(deadline) {
+			start := time.Now()
+			servers, _ := d.GetAll()
+			_assert(time.Since(start) < 20*time.Millisecond, "expect GetAll not to wait for the registry")
+			if strings.Join(servers, ",") == expect {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		_assert(false, "expect servers %q to be watched", expect)
+	}
+	a := registry.HeartbeatService(ts.URL, &registry.ServerItem{Service: "Foo", Addr: "tcp@a"}, time.Minute)
+	defer a.Stop()
+	waitFor("tcp@a")
+	b := registry.HeartbeatService(ts.URL, &registry.ServerItem{Service: "Bar", Addr: "tcp@b"}, time.Minute)
+	defer b.Stop()
+	_ = a.Deregister()
+	waitFor("")
+}
+
+func TestGeeRegistryDiscovery_Failover(t *testing.T) {
+	r := registry.New(time.Minute)
+	defer func() { _ = r.Close() }()
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	a := registry.Heartbeat(ts.URL, "tcp@a", time.Minute)
+	defer a.Stop()
+	b := registry.Heartbeat(ts.URL, "tcp@b", time.Minute)
+	defer b.Stop()
+
+	// discovery fails over to the registries alive
+	dead := "http://" + strings.TrimPrefix(deadAddr(), "tcp@")
+	d := NewGeeRegistryDiscovery(dead+","+ts.URL, time.Minute)
+	defer func() { _ = d.Close() }()
+	servers, err := d.GetAll()
+	_assert(err == nil && strings.Join(servers, ",") == "tcp@a,tcp@b", "expect servers from the registry alive, got %v %v", servers, err)
+	_assert(a.Deregister() == nil, "failed to deregister")
+	for i := 0; i < 50 && len(servers) != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+		servers, _ = d.GetAll()
+	}
+	_assert(len(servers) == 1, "expect discovery to watch the registry alive, got %v", servers)
+}
+
+func TestXClient_SelectModes(t *testing.T) {
+	t.Parallel()
+	slowAddr := startNode(&Node{name: "slow", delay: 300 * time.Millisecond})
+	upAddr := startNode(&Node{name: "up"})
+
+	t.Run("least pending", func(t *testing.T) {
+		xc := NewXClient(NewMultiServerDiscovery([]string{slowAddr, upAddr}), LeastPendingSelect, nil)
+		defer func() { _ = xc.Close() }()
+		var slowReply, reply string
+		slowCall := make(chan error, 1)
+		go func() { slowCall <- xc.Call(context.Background(), "Node.Name", 0, &slowReply) }()
+		time.Sleep(50 * time.Millisecond)
+		err := xc.Call(context.Background(), "Node.Name", 0, &reply)
+		_assert(err == nil && reply == "up", "expect the server without pending calls, got %q %v", reply, err)
+		_assert(<-slowCall == nil && slowReply == "slow", "expect the first call on the first server")
+	})
+	t.Run("p2c", func(t *testing.T) {
+		xc := NewXClient(NewMultiServerDiscovery([]string{slowAddr, upAddr}), P2CSelect, nil)
+		defer func() { _ = xc.Close() }()
+		xc.balancer.observe(slowAddr, 100*time.Millisecond)
+		xc.balancer.observe(upAddr, time.Millisecond)
+		fast := 0
+		for i := 0; i < 100; i++ {
+			if xc.balance(context.Background(), []string{slowAddr, upAddr}) == upAddr {
+				fast++
+			}
+		}
+		_assert(fast > 50, "expect the faster server preferred, got %d of 100", fast)
+	})
+	t.Run("consistent hash", func(t *testing.T) {
+		servers := []string{"tcp@a", "tcp@b", "tcp@c", "tcp@d"}
+		xc := NewXClient(NewMultiServerDiscovery(servers), ConsistentHashSelect, nil)
+		hit := make(map[string]bool)
+		for i := 0; i < 20; i++ {
+			ctx := WithRoutingKey(context.Background(), fmt.Sprintf("key%d", i))
+			s, _ := xc.selectServer(ctx, nil)
+			again, _ := xc.selectServer(ctx, nil)
+			_assert(s == again, "expect the same server for the same key")
+			hit[s] = true
+		}
+		_assert(len(hit) > 1, "expect keys spread over servers")
+	})
+}
+
+func breakerState(xc *XClient, rpcAddr string) BreakerState {
+	for _, s := range xc.BreakerStats() {
+		if s.Addr == rpcAddr {
+			return s.State
+		}
+	}
+	return StateClosed
+}
+
+func TestXClient_Breaker(t *testing.T) {
+	t.Parallel()
+	down := &Node{name: "down", down: true}
+	downAddr := startNode(down)
+	upAddr := startNode(&Node{name: "up"})
+	d := NewMultiServerDiscovery([]string{downAddr})
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetRetryPolicy(nil)
+	xc.SetBreaker(&BreakerConfig{ConsecutiveFailures: 2, Window: time.Minute, OpenTimeout: 100 * time.Millisecond})
+
+	for i := 0; i < 2; i++ {
+		err := xc.Call(context.Background(), "Node.Name", 0, new(string))
+		_assert(errors.Is(err, ErrServerClosed), "expect the error of the server, got %v", err)
+	}
+	stats := xc.BreakerStats()
+	_assert(len(stats) == 1 && stats[0].State == StateOpen && stats[0].ConsecutiveFailures == 2, "expect an open breaker, got %+v", stats)
+	err := xc.Call(context.Background(), "Node.Name", 0, new(string))
+	_assert(errors.Is(err, ErrBreakerOpen) && atomic.LoadInt32(&down.calls) == 2, "expect calls rejected, got %v", err)
+
+	_ = d.Update([]string{downAddr, upAddr})
+	for i := 0; i < 4; i++ {
+		var reply string
+		err := xc.Call(context.Background(), "Node.Name", 0, &reply)
+		_assert(err == nil && reply == "up", "expect the open server skipped, got %q %v", reply, err)
+	}
+	var reply string
+	err = xc.Broadcast(context.Background(), "Node.Name", 0, &reply)
+	_assert(err == nil && reply == "up", "expect Broadcast to skip the open server, got %q %v", reply, err)
+	xc.SetFailMode(Forking)
+	err = xc.Call(context.Background(), "Node.Name", 0, &reply)
+	_assert(err == nil && atomic.LoadInt32(&down.calls) == 2, "expect Forking to skip the open server, got %v", err)
+	xc.SetFailMode(Failover)
+
+	// calls refused before being sent don't count against the server
+	b := &breaker{cfg: &BreakerConfig{ConsecutiveFailures: 1}, windowStart: time.Now()}
+	_assert(b.acquire(), "expect a closed breaker")
+	b.record(notSentError{ErrShutdown})
+	_assert(b.available(), "expect a call not sent ignored")
+	deadXc := newTestXClient(deadAddr())
+	defer func() { _ = deadXc.Close() }()
+	deadXc.SetRetryPolicy(nil)
+	deadXc.SetBreaker(&BreakerConfig{ConsecutiveFailures: 1, Window: time.Minute, OpenTimeout: time.Minute})
+	_ = deadXc.Call(context.Background(), "Node.Name", 0, new(string))
+	_assert(deadXc.BreakerStats()[0].State == StateOpen, "expect an unreachable server to open its breaker")
+
+	time.Sleep(100 * time.Millisecond)
+	_assert(breakerState(xc, downAddr) == StateHalfOpen, "expect a half-open breaker")
+	_ = d.Update([]string{downAddr})
+	_ = xc.Call(context.Background(), "Node.Name", 0, new(string))
+	_assert(breakerState(xc, downAddr) == StateOpen && atomic.LoadInt32(&down.calls) == 3, "expect a failed probe to open again")
+
+	w := httptest.NewRecorder()
+	xc.ServeHTTP(w, httptest.NewRequest("GET", "/debug/geerpc/xclient", nil))
+	_assert(strings.Contains(w.Body.String(), downAddr) && strings.Contains(w.Body.String(), "open"), "expect breakers on the debug page")
+}
+
+func poolConns(xc *XClient, rpcAddr string) []*Client {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	var clients []*Client
+	if p := xc.pools[rpcAddr]; p != nil {
+		for _, pc := range p.conns {
+			clients = append(clients, pc.Client)
+		}
+	}
+	return clients
+}
+
+func TestXClient_Pool(t *testing.T) {
+	t.Parallel()
+	slowAddr := startNode(&Node{name: "slow", delay: 200 * time.Millisecond})
+	upAddr := startNode(&Node{name: "up"})
+
+	t.Run("round robin", func(t *testing.T) {
+		xc := newTestXClient(upAddr)
+		defer func() { _ = xc.Close() }()
+		xc.SetPool(&PoolConfig{Size: 3})
+		used := make(map[*Client]bool)
+		for i := 0; i < 6; i++ {
+			client, err := xc.dial(upAddr)
+			_assert(err == nil, "failed to dial: %v", err)
+			used[client] = true
+		}
+		_assert(len(used) == 3 && len(poolConns(xc, upAddr)) == 3, "expect 3 connections used in turn, got %d", len(used))
+	})
+	t.Run("least pending", func(t *testing.T) {
+		xc := newTestXClient(slowAddr)
+		defer func() { _ = xc.Close() }()
+		xc.SetPool(&PoolConfig{Size: 2, Select: PoolLeastPending})
+		_, _ = xc.dial(slowAddr)
+		_, _ = xc.dial(slowAddr)
+		done := make(chan error, 1)
+		go func() { done <- xc.Call(context.Background(), "Node.Name", 0, new(string)) }()
+		time.Sleep(50 * time.Millisecond)
+		client, _ := xc.dial(slowAddr)
+		_assert(client.NumPending() == 0, "expect the idle connection")
+		_assert(<-done == nil, "expect the slow call to succeed")
+	})
+	t.Run("idle and lifetime", func(t *testing.T) {
+		xc := newTestXClient(upAddr)
+		defer func() { _ = xc.Close() }()
+		xc.SetPool(&PoolConfig{Size: 1, MaxLifetime: 40 * time.Millisecond})
+		first, _ := xc.dial(upAddr)
+		time.Sleep(50 * time.Millisecond)
+		second, _ := xc.dial(upAddr)
+		_assert(first != second && !first.IsAvailable(), "expect an old connection replaced and closed")
+
+		xc = newTestXClient(upAddr)
+		defer func() { _ = xc.Close() }()
+		xc.SetPool(&PoolConfig{Size: 1, IdleTimeout: 40 * time.Millisecond})
+		second, _ = xc.dial(upAddr)
+		time.Sleep(100 * time.Millisecond)
+		_assert(len(poolConns(xc, upAddr)) == 0 && !second.IsAvailable(), "expect an idle connection reaped")
+
+		xc = newTestXClient(upAddr)
+		defer func() { _ = xc.Close() }()
+		xc.SetPool(&PoolConfig{Size: 1, IdleTimeout: time.Nanosecond})
+		_, err := xc.dial(upAddr)
+		_assert(err == nil, "expect a tiny idle timeout to work, got %v", err)
+	})
+	t.Run("slow dial", func(t *testing.T) {
+		// a server that never answers the handshake
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		defer func() { _ = l.Close() }()
+		silentAddr := "tcp@" + l.Addr().String()
+		xc := NewXClient(NewMultiServerDiscovery([]string{silentAddr, upAddr}), RoundRobinSelect, &Option{ConnectTimeout: time.Second})
+		defer func() { _ = xc.Close() }()
+		go func() { _, _ = xc.dial(silentAddr) }()
+		time.Sleep(50 * time.Millisecond)
+		start := time.Now()
+		_, err := xc.dial(upAddr)
+		_assert(err == nil && time.Since(start) < 500*time.Millisecond, "expect other servers not to wait for a slow dial")
+	})
+}